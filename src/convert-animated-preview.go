@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/types"
+)
+
+// animatedPreviewAttempts limits re-encoding of animated previews exceeding AnimatedMaxBytes
+const animatedPreviewAttempts = 5
+
+// animatedExtensions maps supported AnimatedType values to file extensions
+var animatedExtensions = map[string]string{
+	"webp": "webp",
+	"gif":  "gif",
+	"apng": "apng",
+}
+
+// CreateAnimatedPreview encodes animated-preview-<name>.<type> image from the preview segments into targetPath
+// in one ffmpeg pass from the planned source.
+// When the image exceeds AnimatedMaxBytes it's re-encoded with smaller size and frame rate,
+// the last attempt is kept even if it's still too large.
+func CreateAnimatedPreview(source previewSource, format types.ThumbFormatShort, targetPath string) (resultFile string, err error) {
+	animatedType := format.AnimatedType
+	if animatedType == "" {
+		animatedType = "webp"
+	}
+	ext, ok := animatedExtensions[animatedType]
+	if !ok {
+		err = errors.New("unsupported animated preview type " + animatedType)
+		return
+	}
+	size := format.AnimatedSize
+	if size.Width <= 0 || size.Height <= 0 {
+		size = format.VideoSize
+	}
+	if size.Width <= 0 || size.Height <= 0 {
+		size = format.Size
+	}
+	fps := format.AnimatedFPS
+	if fps <= 0 {
+		fps = 10
+	}
+	resultFile = filepath.Join(targetPath, fmt.Sprintf("animated-preview-%s.%s", format.Name, ext))
+	for attempt := 0; attempt < animatedPreviewAttempts; attempt++ {
+		err = encodeAnimatedPreview(source, resultFile, animatedType, size, fps, format.AnimatedLoop)
+		if err != nil {
+			return
+		}
+		if format.AnimatedMaxBytes <= 0 {
+			return
+		}
+		var fi os.FileInfo
+		fi, err = os.Stat(resultFile)
+		if err != nil {
+			return
+		}
+		if fi.Size() <= format.AnimatedMaxBytes {
+			return
+		}
+		log.Printf("animated preview %s is %d bytes, more than %d, reducing", filepath.Base(resultFile), fi.Size(), format.AnimatedMaxBytes)
+		size = types.Size{Width: size.Width * 4 / 5 / 2 * 2, Height: size.Height * 4 / 5 / 2 * 2}
+		fps = max(5, fps*0.8)
+	}
+	return
+}
+
+func encodeAnimatedPreview(source previewSource, resultFile string, animatedType string, size types.Size, fps float64, loop int32) error {
+	graph := source.videoGraph() + fmt.Sprintf(";[pv]fps=%s,scale=%d:%d:force_original_aspect_ratio=increase:flags=lanczos,crop=%d:%d",
+		strconv.FormatFloat(fps, 'f', 2, 64), size.Width, size.Height, size.Width, size.Height)
+	if animatedType == "gif" {
+		// Palette generated from the whole clip gives far better colors than the default one
+		graph += ",split[a][b];[a]palettegen=stats_mode=diff[p];[b][p]paletteuse=dither=bayer:bayer_scale=5:diff_mode=rectangle"
+	}
+	graph += "[out]"
+	args := []string{"-y", "-hide_banner", "-loglevel", "error"}
+	args = append(args, source.inputArgs()...)
+	args = append(args, "-filter_complex", graph, "-map", "[out]", "-an")
+	switch animatedType {
+	case "gif":
+		args = append(args, "-loop", strconv.Itoa(int(loop)), "-f", "gif")
+	case "apng":
+		args = append(args, "-plays", strconv.Itoa(int(loop)), "-f", "apng")
+	default:
+		args = append(args, "-c:v", "libwebp", "-lossless", "0", "-quality", "70",
+			"-compression_level", "6", "-loop", strconv.Itoa(int(loop)), "-f", "webp")
+	}
+	args = append(args, resultFile)
+	out, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		log.Printf("Error creating animated preview: %s", string(out))
+		return errors.Wrap(err, "can't create "+animatedType+" animated preview")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
+)
+
+var showinfoPtsTimeRegexp = regexp.MustCompile(`pts_time:\s*([\d.]+)`)
+
+// chaptersThumbTypes are supported ChaptersThumbType values
+var chaptersThumbTypes = []string{"jpg", "webp", "png"}
+
+// CreateChapters detects scene changes in the video, merges scenes into chapters not shorter than
+// ChaptersMinLength and writes chapters-<name>.vtt, chapters-<name>.json and a thumbnail per chapter to targetPath.
+// chapters-<name>.thumbs.vtt has the same cues with chapter thumbnails as payload.
+func CreateChapters(videoFile string, tempPath string, targetPath string, duration float64, format types.VideoFormatShort) (chapters []types.VideoChapter, err error) {
+	minLength := format.ChaptersMinLength
+	if minLength <= 0 {
+		minLength = 60
+	}
+	threshold := format.ChaptersSceneThreshold
+	if threshold <= 0 || threshold >= 1 {
+		threshold = 0.4
+	}
+	thumbType := format.ChaptersThumbType
+	if thumbType == "" {
+		thumbType = "jpg"
+	}
+	if !slices.Contains(chaptersThumbTypes, thumbType) {
+		err = errors.New("unsupported chapters thumb type " + thumbType)
+		return
+	}
+	thumbSize := format.ChaptersThumbSize
+	if thumbSize.Width <= 0 || thumbSize.Height <= 0 {
+		thumbSize = types.Size{Width: 320, Height: 180}
+	}
+	var scenes []float64
+	scenes, err = detectScenes(videoFile, threshold)
+	if err != nil {
+		return
+	}
+	starts := mergeScenes(scenes, duration, minLength)
+	chaptersPath := filepath.Join(tempPath, "chapters")
+	_ = os.MkdirAll(chaptersPath, os.ModePerm)
+	var vttContents, thumbsVttContents strings.Builder
+	vttContents.WriteString("WEBVTT\n\n")
+	thumbsVttContents.WriteString("WEBVTT\n\n")
+	for k, start := range starts {
+		end := duration
+		if k < len(starts)-1 {
+			end = starts[k+1]
+		}
+		chapter := types.VideoChapter{
+			Title:     fmt.Sprintf("Chapter %d", k+1),
+			Start:     start,
+			End:       end,
+			Thumbnail: fmt.Sprintf("chapter-%s.%d.%s", format.Name, k, thumbType),
+		}
+		frameFile := filepath.Join(chaptersPath, fmt.Sprintf("%d.png", k))
+		err = ExtractFrame(videoFile, time.Duration((start+end)/2*float64(time.Second)), frameFile)
+		if err != nil {
+			err = errors.Wrap(err, "can't extract chapter thumbnail")
+			return
+		}
+		err = ConvertImage(frameFile, "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% -quality 85 %RESULT_FILE%",
+			filepath.Join(targetPath, chapter.Thumbnail), fmt.Sprintf("%dx%d", thumbSize.Width, thumbSize.Height))
+		if err != nil {
+			err = errors.Wrap(err, "can't convert chapter thumbnail")
+			return
+		}
+		vttContents.WriteString(fmt.Sprintf("%d\n%s --> %s\n%s\n\n", k+1,
+			helpers.FormatVTTTime(chapter.Start), helpers.FormatVTTTime(chapter.End), chapter.Title))
+		thumbsVttContents.WriteString(fmt.Sprintf("%d\n%s --> %s\n%s\n\n", k+1,
+			helpers.FormatVTTTime(chapter.Start), helpers.FormatVTTTime(chapter.End), chapter.Thumbnail))
+		chapters = append(chapters, chapter)
+	}
+	err = os.WriteFile(filepath.Join(targetPath, fmt.Sprintf("chapters-%s.vtt", format.Name)), []byte(vttContents.String()), 0644)
+	if err != nil {
+		err = errors.Wrap(err, "can't write chapters vtt file")
+		return
+	}
+	err = os.WriteFile(filepath.Join(targetPath, fmt.Sprintf("chapters-%s.thumbs.vtt", format.Name)), []byte(thumbsVttContents.String()), 0644)
+	if err != nil {
+		err = errors.Wrap(err, "can't write chapters thumbnails vtt file")
+		return
+	}
+	var jsonContents []byte
+	jsonContents, err = json.Marshal(chapters)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(filepath.Join(targetPath, fmt.Sprintf("chapters-%s.json", format.Name)), jsonContents, 0644)
+	if err != nil {
+		err = errors.Wrap(err, "can't write chapters json file")
+		return
+	}
+	return
+}
+
+// detectScenes returns timestamps of frames where scene change score exceeds the threshold
+func detectScenes(videoFile string, threshold float64) (scenes []float64, err error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-i", videoFile, "-an", "-sn",
+		"-vf", fmt.Sprintf("scale=320:-2,select='gt(scene,%s)',showinfo", strconv.FormatFloat(threshold, 'f', 3, 64)),
+		"-f", "null", "-")
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		log.Println(stderr.String())
+		err = errors.Wrap(err, "can't detect scenes")
+		return
+	}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if !strings.Contains(line, "Parsed_showinfo") {
+			continue
+		}
+		if matches := showinfoPtsTimeRegexp.FindStringSubmatch(line); matches != nil {
+			if t, err := strconv.ParseFloat(matches[1], 64); err == nil {
+				scenes = append(scenes, t)
+			}
+		}
+	}
+	return
+}
+
+// mergeScenes turns scene changes into chapter start times, skipping those which would make chapters shorter than minLength
+func mergeScenes(scenes []float64, duration float64, minLength float64) []float64 {
+	var starts = []float64{0}
+	for _, t := range scenes {
+		if t-starts[len(starts)-1] >= minLength && duration-t >= minLength {
+			starts = append(starts, t)
+		}
+	}
+	return starts
+}
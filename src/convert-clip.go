@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
+)
+
+// keyframeTolerance is the max distance in seconds between a cut and a keyframe to treat the cut as landing on it
+const keyframeTolerance = 0.05
+
+// validateClipRanges checks that ranges are given in chronological order and don't overlap
+func validateClipRanges(ranges []types.ClipRange) error {
+	if len(ranges) == 0 {
+		return errors.New("no clip ranges provided")
+	}
+	for k, r := range ranges {
+		if r.Start < 0 || r.End <= r.Start {
+			return fmt.Errorf("wrong clip range %d: %.3f - %.3f", k, r.Start, r.End)
+		}
+		if k > 0 && r.Start < ranges[k-1].End {
+			return fmt.Errorf("clip range %d (%.3f - %.3f) overlaps or precedes the previous one", k, r.Start, r.End)
+		}
+	}
+	return nil
+}
+
+// MakeClip cuts ranges out of the source video and joins them into video-<name>.<type> in targetPath.
+// Stream copy is used when every cut starts on a keyframe and the source fits the format, otherwise ranges are re-encoded.
+func MakeClip(sourceFile string, tempPath string, targetPath string, ranges []types.ClipRange, format types.VideoFormatShort) (info types.ContentVideoInfo, err error) {
+	if err = validateClipRanges(ranges); err != nil {
+		return
+	}
+	if format.Type == "" {
+		format.Type = "mp4"
+	}
+	sourceFile, _ = filepath.Abs(sourceFile)
+	var fileFormat types.FileFormat
+	fileFormat, err = probeFile(sourceFile)
+	if err != nil {
+		return
+	}
+	duration, _ := strconv.ParseFloat(fileFormat.Format.Duration, 64)
+	if duration <= 0 {
+		err = errors.New("wrong duration of source video: " + fileFormat.Format.Duration)
+		return
+	}
+	videoStream, audioStream := probeStreams(fileFormat)
+	if videoStream == nil {
+		err = errors.New("no video stream in source file")
+		return
+	}
+	for k := range ranges {
+		if ranges[k].End > duration {
+			ranges[k].End = duration
+		}
+		if ranges[k].Start < 0 || ranges[k].End-ranges[k].Start < 0.1 {
+			err = fmt.Errorf("wrong clip range %d: %.3f - %.3f (video duration %.3f)", k, ranges[k].Start, ranges[k].End, duration)
+			return
+		}
+	}
+	var audioCodec string
+	if audioStream != nil {
+		audioCodec = audioStream.CodecName
+	}
+	streamCopy := canCopyCodecs(format.Type, videoStream.CodecName, audioCodec)
+	if format.Size.Width > 0 && format.Size.Height > 0 && !videoSizeOk(format, videoStream.Width, videoStream.Height) {
+		streamCopy = false
+	}
+	if streamCopy {
+		var keyframes []float64
+		keyframes, err = probeKeyframes(sourceFile)
+		if err != nil {
+			return
+		}
+		for _, r := range ranges {
+			if !onKeyframe(r.Start, keyframes) {
+				streamCopy = false
+				break
+			}
+		}
+	}
+	resultFile := filepath.Join(targetPath, fmt.Sprintf("video-%s.%s", format.Name, format.Type))
+	if streamCopy {
+		err = cutClipCopy(sourceFile, tempPath, resultFile, ranges, format)
+	} else {
+		err = cutClipEncode(sourceFile, resultFile, ranges, videoStream, audioStream != nil, format)
+	}
+	if err != nil {
+		return
+	}
+	if !helpers.FileExists(resultFile) {
+		err = errors.New("result file " + resultFile + " not created during clip cutting. Something is wrong.")
+		return
+	}
+	info, err = readVideoInfo(resultFile, format)
+	if err != nil {
+		return
+	}
+	info.StreamCopy = streamCopy
+	if format.CreatePoster {
+		err = createPoster(resultFile, tempPath, targetPath, info.Duration, format, &info)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func onKeyframe(t float64, keyframes []float64) bool {
+	for _, k := range keyframes {
+		if math.Abs(k-t) <= keyframeTolerance {
+			return true
+		}
+	}
+	return false
+}
+
+func cutClipCopy(sourceFile string, tempPath string, resultFile string, ranges []types.ClipRange, format types.VideoFormatShort) error {
+	clipPath := filepath.Join(tempPath, "clip_parts")
+	err := os.MkdirAll(clipPath, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "can't create clip parts directory")
+	}
+	var concatContent strings.Builder
+	for k, r := range ranges {
+		partFile := filepath.Join(clipPath, fmt.Sprintf("part_%d.%s", k, format.Type))
+		cmd := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error",
+			"-ss", strconv.FormatFloat(r.Start, 'f', 3, 64),
+			"-i", sourceFile,
+			"-t", strconv.FormatFloat(r.End-r.Start, 'f', 3, 64),
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-c", "copy",
+			"-avoid_negative_ts", "make_zero",
+			partFile)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Printf("Error cutting clip part %d: %s", k, string(out))
+			return errors.Wrapf(err, "can't cut clip part %d", k)
+		}
+		concatContent.WriteString(fmt.Sprintf("file '%s'\n", partFile))
+	}
+	concatFile := filepath.Join(clipPath, "concat.txt")
+	err = os.WriteFile(concatFile, []byte(concatContent.String()), 0644)
+	if err != nil {
+		return errors.Wrap(err, "can't write concat file")
+	}
+	args := []string{"-y", "-hide_banner", "-loglevel", "error",
+		"-f", "concat", "-safe", "0", "-i", concatFile, "-c", "copy"}
+	args = append(args, metadataArgs(format.Metadata)...)
+	args = append(args, movflagsArgs(format.Type, format.Metadata)...)
+	args = append(args, resultFile)
+	out, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		log.Printf("Error joining clip parts: %s", string(out))
+		return errors.Wrap(err, "can't join clip parts")
+	}
+	return nil
+}
+
+func cutClipEncode(sourceFile string, resultFile string, ranges []types.ClipRange, videoStream *types.FStream, hasAudio bool, format types.VideoFormatShort) error {
+	args := []string{"-y", "-hide_banner", "-loglevel", "error"}
+	var filter strings.Builder
+	for k, r := range ranges {
+		args = append(args,
+			"-ss", strconv.FormatFloat(r.Start, 'f', 3, 64),
+			"-t", strconv.FormatFloat(r.End-r.Start, 'f', 3, 64),
+			"-i", sourceFile)
+		filter.WriteString(fmt.Sprintf("[%d:v:0]setpts=PTS-STARTPTS[v%d];", k, k))
+		if hasAudio {
+			filter.WriteString(fmt.Sprintf("[%d:a:0]asetpts=PTS-STARTPTS[a%d];", k, k))
+		}
+	}
+	for k := range ranges {
+		filter.WriteString(fmt.Sprintf("[v%d]", k))
+		if hasAudio {
+			filter.WriteString(fmt.Sprintf("[a%d]", k))
+		}
+	}
+	audioCount := 0
+	if hasAudio {
+		audioCount = 1
+	}
+	filter.WriteString(fmt.Sprintf("concat=n=%d:v=1:a=%d[vc]", len(ranges), audioCount))
+	if hasAudio {
+		filter.WriteString("[ac]")
+	}
+	filter.WriteString(";[vc]")
+	if format.Size.Width > 0 && format.Size.Height > 0 && !videoSizeOk(format, videoStream.Width, videoStream.Height) {
+		filter.WriteString(scaleFilter(format, videoStream.Width, videoStream.Height))
+	} else {
+		filter.WriteString("null")
+	}
+	filter.WriteString("[vout]")
+	args = append(args, "-filter_complex", filter.String(), "-map", "[vout]")
+	if hasAudio {
+		args = append(args, "-map", "[ac]")
+	}
+	switch format.Type {
+	case "webm":
+		args = append(args, "-c:v", "libvpx-vp9", "-c:a", "libopus")
+		if format.VideoBitrate == 0 {
+			args = append(args, "-crf", "32", "-b:v", "0")
+		}
+	case "ogg":
+		args = append(args, "-c:v", "libtheora", "-c:a", "libvorbis")
+	default:
+		args = append(args, "-c:v", "libx264", "-preset", "fast", "-c:a", "aac")
+		if format.VideoBitrate == 0 {
+			args = append(args, "-crf", "21")
+		}
+	}
+	if format.VideoBitrate > 0 {
+		args = append(args, "-b:v", fmt.Sprintf("%dk", format.VideoBitrate))
+	}
+	if hasAudio && format.AudioBitrate > 0 {
+		args = append(args, "-b:a", fmt.Sprintf("%dk", format.AudioBitrate))
+	}
+	args = append(args, metadataArgs(format.Metadata)...)
+	args = append(args, movflagsArgs(format.Type, format.Metadata)...)
+	args = append(args, resultFile)
+	out, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		log.Printf("Error encoding clip: %s", string(out))
+		return errors.Wrap(err, "can't encode clip for format "+format.Name)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
+)
+
+// concatSources joins multipart sources into a single file inside tempPath.
+// Parts with the same container and stream parameters are joined losslessly with the concat demuxer,
+// anything else is normalized and joined with the concat filter.
+func concatSources(sourceFiles []string, tempPath string) (sourceFile string, err error) {
+	var parts = make([]types.FileFormat, len(sourceFiles))
+	for k, f := range sourceFiles {
+		parts[k], err = probeFile(f)
+		if err != nil {
+			err = errors.Wrap(err, "can't probe source part "+filepath.Base(f))
+			return
+		}
+	}
+	fileExtension := strings.ToLower(filepath.Ext(sourceFiles[0]))
+	sameExtension := true
+	for _, f := range sourceFiles[1:] {
+		if strings.ToLower(filepath.Ext(f)) != fileExtension {
+			sameExtension = false
+			break
+		}
+	}
+	if sameExtension && sourcePartsCompatible(parts) {
+		sourceFile, err = concatSourcesDemuxer(sourceFiles, tempPath, fileExtension)
+		if err == nil {
+			return
+		}
+		log.Println(err, "- trying to concatenate with re-encoding")
+	}
+	return concatSourcesFilter(sourceFiles, parts, tempPath)
+}
+
+func concatSourcesDemuxer(sourceFiles []string, tempPath string, fileExtension string) (sourceFile string, err error) {
+	concatFile := ""
+	for _, f := range sourceFiles {
+		absPath, _ := filepath.Abs(f)
+		concatFile += "file " + absPath + "\n"
+	}
+	concatFilePath := filepath.Join(tempPath, "concat.txt")
+	err = os.WriteFile(concatFilePath, []byte(concatFile), 0644)
+	if err != nil {
+		err = errors.New("can't write " + concatFilePath + " file: " + err.Error())
+		return
+	}
+	sourceFile = filepath.Join(tempPath, "__file"+fileExtension)
+	command := exec.Command("ffmpeg", "-y", "-f", "concat", "-safe", "0", "-i", concatFilePath, "-c", "copy", sourceFile)
+	var out []byte
+	out, err = command.CombinedOutput()
+	if err != nil {
+		log.Println(string(out))
+		err = errors.New("can't concatenate video files " + helpers.ToJSON(sourceFiles) + ": " + err.Error())
+		return
+	}
+	return
+}
+
+// concatSourcesFilter scales and pads every part to the same size, frame rate and audio layout and joins them
+func concatSourcesFilter(sourceFiles []string, parts []types.FileFormat, tempPath string) (sourceFile string, err error) {
+	var width, height int
+	var fps float64
+	var hasAudio bool
+	for _, part := range parts {
+		video, audio := probeStreams(part)
+		if video == nil {
+			err = errors.New("one of source parts has no video stream")
+			return
+		}
+		if video.Width*video.Height > width*height {
+			width, height = video.Width, video.Height
+		}
+		fps = math.Max(fps, parseFrameRate(video.RFrameRate))
+		if audio != nil {
+			hasAudio = true
+		}
+	}
+	if fps <= 0 || fps > 60 {
+		fps = math.Min(60, math.Max(fps, 30))
+	}
+	// yuv420p needs even dimensions
+	width, height = width/2*2, height/2*2
+	var args = []string{"-y", "-hide_banner", "-loglevel", "error"}
+	var filter strings.Builder
+	for k, f := range sourceFiles {
+		absPath, _ := filepath.Abs(f)
+		args = append(args, "-i", absPath)
+		filter.WriteString(fmt.Sprintf(
+			"[%d:v:0]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%s,format=yuv420p,setpts=PTS-STARTPTS[v%d];",
+			k, width, height, width, height, strconv.FormatFloat(fps, 'f', 3, 64), k))
+		if !hasAudio {
+			continue
+		}
+		if _, audio := probeStreams(parts[k]); audio != nil {
+			filter.WriteString(fmt.Sprintf(
+				"[%d:a:0]aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo,asetpts=PTS-STARTPTS[a%d];", k, k))
+		} else {
+			partDuration, _ := strconv.ParseFloat(parts[k].Format.Duration, 64)
+			filter.WriteString(fmt.Sprintf(
+				"anullsrc=r=48000:cl=stereo,atrim=duration=%s,aformat=sample_fmts=fltp[a%d];",
+				strconv.FormatFloat(partDuration, 'f', 3, 64), k))
+		}
+	}
+	for k := range sourceFiles {
+		filter.WriteString(fmt.Sprintf("[v%d]", k))
+		if hasAudio {
+			filter.WriteString(fmt.Sprintf("[a%d]", k))
+		}
+	}
+	if hasAudio {
+		filter.WriteString(fmt.Sprintf("concat=n=%d:v=1:a=1[vout][aout]", len(sourceFiles)))
+	} else {
+		filter.WriteString(fmt.Sprintf("concat=n=%d:v=1:a=0[vout]", len(sourceFiles)))
+	}
+	args = append(args, "-filter_complex", filter.String(), "-map", "[vout]")
+	if hasAudio {
+		args = append(args, "-map", "[aout]", "-c:a", "aac", "-b:a", "192k")
+	}
+	// Intermediate file, will be encoded again, so keeping quality high
+	sourceFile = filepath.Join(tempPath, "__file.mkv")
+	args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "18", sourceFile)
+	command := exec.Command("ffmpeg", args...)
+	var out []byte
+	out, err = command.CombinedOutput()
+	if err != nil {
+		log.Println(string(out))
+		err = errors.New("can't concatenate video files with re-encoding " + helpers.ToJSON(sourceFiles) + ": " + err.Error())
+		return
+	}
+	return
+}
+
+// sourcePartsCompatible checks if all parts share codecs and stream parameters, so they can be joined by the concat demuxer
+func sourcePartsCompatible(parts []types.FileFormat) bool {
+	firstVideo, firstAudio := probeStreams(parts[0])
+	if firstVideo == nil {
+		return false
+	}
+	for _, part := range parts[1:] {
+		video, audio := probeStreams(part)
+		if video == nil || video.CodecName != firstVideo.CodecName || video.Width != firstVideo.Width ||
+			video.Height != firstVideo.Height || video.RFrameRate != firstVideo.RFrameRate {
+			return false
+		}
+		if (audio == nil) != (firstAudio == nil) {
+			return false
+		}
+		if audio != nil && (audio.CodecName != firstAudio.CodecName || audio.SampleRate != firstAudio.SampleRate ||
+			audio.Channels != firstAudio.Channels) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFrameRate parses ffprobe rational frame rate like 30000/1001
+func parseFrameRate(rate string) float64 {
+	numDen := strings.Split(rate, "/")
+	num, err := strconv.ParseFloat(numDen[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(numDen) == 2 {
+		den, err := strconv.ParseFloat(numDen[1], 64)
+		if err != nil || den == 0 {
+			return 0
+		}
+		return num / den
+	}
+	return num
+}
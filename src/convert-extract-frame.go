@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -55,6 +56,105 @@ func ExtractFrame(fileName string, seek time.Duration, outFilename string) error
 	return nil
 }
 
+// extractFramesBatch limits inputs of one ffmpeg process, every input keeps its own decoder
+const extractFramesBatch = 16
+
+// ExtractFrames extracts frames at seeks (in seconds) into outFilenames with one ffmpeg process for up to
+// extractFramesBatch frames. Every frame is a separate input seeked to its time, so only the needed parts
+// of the video are decoded. As ExtractFrame does, 3 frames are taken from each seek and the largest png is kept,
+// so the frame with most details wins over black or blurred transition ones. With keyframesOnly the keyframe
+// before each seek is taken without decoding anything else, it's much faster but the frame time is approximate.
+func ExtractFrames(fileName string, seeks []float64, outFilenames []string, keyframesOnly bool) error {
+	framesPerSeek := 3
+	if keyframesOnly {
+		framesPerSeek = 1
+	}
+	missing, err := extractFrames(fileName, seeks, outFilenames, keyframesOnly, framesPerSeek)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.New("can't extract frame at " + strconv.FormatFloat(seeks[missing[0]], 'f', 2, 64) +
+			" from video file " + fileName)
+	}
+	return nil
+}
+
+// extractFrames extracts framesPerSeek frames from each seek and keeps the largest of them in outFilenames.
+// Indexes of seeks without any frame, like ones after the end of the video stream, are returned in missing.
+func extractFrames(fileName string, seeks []float64, outFilenames []string, keyframesOnly bool, framesPerSeek int) (missing []int, err error) {
+	if len(seeks) != len(outFilenames) {
+		err = errors.New("seeks and output files count mismatch")
+		return
+	}
+	tmpdir := filepath.Join(conversionPath, "tmp", xid.New().String())
+	if err = os.MkdirAll(tmpdir, 0755); err != nil {
+		err = errors.New("can't create temporary directory " + tmpdir + ": " + err.Error())
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+	for from := 0; from < len(seeks); from += extractFramesBatch {
+		to := min(from+extractFramesBatch, len(seeks))
+		args := []string{"-y", "-hide_banner", "-loglevel", "error"}
+		for _, seek := range seeks[from:to] {
+			if keyframesOnly {
+				args = append(args, "-skip_frame", "nokey", "-noaccurate_seek")
+			}
+			args = append(args, "-ss", strconv.FormatFloat(seek, 'f', 3, 64), "-i", fileName)
+		}
+		for k := range seeks[from:to] {
+			args = append(args, "-map", fmt.Sprintf("%d:v:0", k), "-frames:v", strconv.Itoa(framesPerSeek), "-f", "image2",
+				filepath.Join(tmpdir, fmt.Sprintf("frame.%d.%%d.png", from+k)))
+		}
+		var out []byte
+		out, err = exec.Command("ffmpeg", args...).CombinedOutput()
+		if err != nil {
+			log.Println(string(out))
+			err = errors.New("can't extract frames from video file " + fileName + ": " + err.Error())
+			return
+		}
+	}
+	for k, outFilename := range outFilenames {
+		matches, _ := filepath.Glob(filepath.Join(tmpdir, fmt.Sprintf("frame.%d.*.png", k)))
+		var biggestFile string
+		var maxSize int64
+		for _, m := range matches {
+			fi, err1 := os.Stat(m)
+			if err1 != nil {
+				err = errors.New("can't stat frame file " + m)
+				return
+			}
+			if fi.Size() > maxSize {
+				biggestFile = m
+				maxSize = fi.Size()
+			}
+		}
+		if biggestFile == "" {
+			missing = append(missing, k)
+			continue
+		}
+		if err = os.Rename(biggestFile, outFilename); err != nil {
+			err = errors.Wrap(err, "can't move file "+biggestFile+" to "+outFilename)
+			return
+		}
+	}
+	return
+}
+
+// extractLastFrame extracts the last frame of the video stream, which may end before the container duration
+func extractLastFrame(fileName string, outFilename string) error {
+	out, err := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error", "-sseof", "-3", "-i", fileName,
+		"-map", "0:v:0", "-f", "image2", "-update", "1", outFilename).CombinedOutput()
+	if err != nil {
+		log.Println(string(out))
+		return errors.New("can't extract last frame from video file " + fileName + ": " + err.Error())
+	}
+	if !helpers.FileExists(outFilename) {
+		return errors.New("can't extract last frame from video file " + fileName)
+	}
+	return nil
+}
+
 func ExtractFrameAction(sourceFile, extractTime, outFilename string) error {
 	dur := helpers.ParseHumanDuration(extractTime)
 	if !helpers.FileExists(sourceFile) {
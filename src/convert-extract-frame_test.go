@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// benchmarkFixture is a test video generated with lavfi testsrc
+type benchmarkFixture struct {
+	name     string
+	duration float64
+	size     string
+	gop      int
+}
+
+// benchmarkFixtures are a short clip and a long source with sparse keyframes, where the frames are far apart
+var benchmarkFixtures = []benchmarkFixture{
+	{name: "60s", duration: 60, size: "1280x720", gop: 50},
+	{name: "2h", duration: 7200, size: "640x360", gop: 250},
+}
+
+// runExtractBenchmark generates the fixtures and runs extract for each of them with 10 evenly spread seeks
+func runExtractBenchmark(b *testing.B, extract func(video string, seeks []float64, outFilenames []string) error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		b.Skip("ffmpeg is not installed")
+	}
+	conversionPath = b.TempDir()
+	for _, fixture := range benchmarkFixtures {
+		video := filepath.Join(conversionPath, "video-"+fixture.name+".mp4")
+		out, err := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error",
+			"-f", "lavfi", "-i", fmt.Sprintf("testsrc=duration=%.0f:size=%s:rate=25", fixture.duration, fixture.size),
+			"-g", fmt.Sprint(fixture.gop), "-pix_fmt", "yuv420p", video).CombinedOutput()
+		if err != nil {
+			b.Fatal(string(out), err)
+		}
+		var seeks []float64
+		var outFilenames []string
+		for k := 0; k < 10; k++ {
+			seeks = append(seeks, fixture.duration*float64(k+1)/11)
+			outFilenames = append(outFilenames, filepath.Join(conversionPath, fmt.Sprintf("frame.%d.png", k)))
+		}
+		b.Run(fixture.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := extract(video, seeks, outFilenames); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExtractFramePerFrame(b *testing.B) {
+	runExtractBenchmark(b, func(video string, seeks []float64, outFilenames []string) error {
+		for k, seek := range seeks {
+			if err := ExtractFrame(video, time.Duration(seek*float64(time.Second)), outFilenames[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkExtractFrames(b *testing.B) {
+	runExtractBenchmark(b, func(video string, seeks []float64, outFilenames []string) error {
+		return ExtractFrames(video, seeks, outFilenames, false)
+	})
+}
+
+func BenchmarkExtractFramesKeyframes(b *testing.B) {
+	runExtractBenchmark(b, func(video string, seeks []float64, outFilenames []string) error {
+		return ExtractFrames(video, seeks, outFilenames, true)
+	})
+}
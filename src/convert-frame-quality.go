@@ -0,0 +1,310 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
+)
+
+// scoredFrame is a frame extracted from the video with its timestamp, quality score and perceptual hash
+type scoredFrame struct {
+	file  string
+	time  float64
+	score helpers.ImageScore
+	hash  uint64
+}
+
+// frameFilter accepts frames and images passing FrameQuality thresholds and not duplicating
+// already accepted ones of the request
+type frameFilter struct {
+	quality types.FrameQuality
+	hashes  []uint64
+}
+
+func newFrameFilter(quality types.FrameQuality) *frameFilter {
+	return &frameFilter{quality: quality}
+}
+
+// scoreFile decodes the image and returns its score and hash
+func (f *frameFilter) scoreFile(imageFile string) (score helpers.ImageScore, hash uint64, err error) {
+	im, err := helpers.DecodeImageFile(imageFile)
+	if err != nil {
+		return
+	}
+	score = helpers.ScoreImage(im)
+	if f.quality.DedupDistance > 0 {
+		hash = helpers.DHash(im)
+	}
+	return
+}
+
+// checkImage scores the source image when the filter is enabled. Source images are only deduplicated,
+// quality thresholds apply to video frames. Images that can't be decoded here may still be converted,
+// they are not deduplicated then. remember tells to add the hash once the image is accepted.
+func (f *frameFilter) checkImage(imageFile string) (score helpers.ImageScore, hash uint64, duplicate bool, remember bool) {
+	if !f.quality.Enabled() {
+		return
+	}
+	score, hash, err := f.scoreFile(imageFile)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !f.unique(hash) {
+		duplicate = true
+		return
+	}
+	remember = true
+	return
+}
+
+// accepts checks the thresholds and the distance to accepted hashes
+func (f *frameFilter) accepts(score helpers.ImageScore, hash uint64) bool {
+	return f.quality.Accepts(score) && f.unique(hash)
+}
+
+// unique tells if the hash is farther than DedupDistance from all accepted hashes
+func (f *frameFilter) unique(hash uint64) bool {
+	if f.quality.DedupDistance > 0 {
+		for _, accepted := range f.hashes {
+			if helpers.HammingDistance(hash, accepted) <= int(f.quality.DedupDistance) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// add remembers the hash of the accepted item
+func (f *frameFilter) add(hash uint64) {
+	if f.quality.DedupDistance > 0 {
+		f.hashes = append(f.hashes, hash)
+	}
+}
+
+// extractScoredFrames extracts frames with doExtractFrames2. Frames are scored only with the filter enabled,
+// then rejected frames are replaced with the frames shifted forward and back from their timestamps, not further
+// than half the distance to the neighbour frames. Frames without acceptable replacement are dropped and
+// refilled from new timestamps in the largest gaps between the tried ones, until the planned amount is reached
+// or the gaps get shorter than a quarter of the planned interval (half a second at least).
+// If nothing was accepted at all the best scored frame is kept.
+func extractScoredFrames(file string, destinationPath string, maxAmount int64, interval float64, randomize bool,
+	keyframesOnly bool, filter *frameFilter) (frames []scoredFrame, err error) {
+	times, err := doExtractFrames2(file, destinationPath, maxAmount, interval, randomize, keyframesOnly)
+	if err != nil {
+		return
+	}
+	for k, t := range times {
+		frame := scoredFrame{file: filepath.Join(destinationPath, "frame."+strconv.Itoa(k)+".png"), time: t}
+		if filter.quality.Enabled() {
+			frame.score, frame.hash, err = filter.scoreFile(frame.file)
+			if err != nil {
+				return
+			}
+		}
+		frames = append(frames, frame)
+	}
+	if !filter.quality.Enabled() || len(frames) == 0 {
+		return
+	}
+	var duration float64
+	var fileFormat types.FileFormat
+	if fileFormat, err = probeFile(file); err != nil {
+		return
+	}
+	duration, _ = strconv.ParseFloat(fileFormat.Format.Duration, 64)
+	attempts := int(filter.quality.ReplaceAttempts)
+	if attempts <= 0 {
+		attempts = 3
+	}
+	// steps are spread over the half of the gap to the nearest neighbour in each direction
+	steps := make([]float64, len(frames))
+	for k := range frames {
+		gap := duration
+		if k > 0 {
+			gap = min(gap, times[k]-times[k-1])
+		}
+		if k < len(frames)-1 {
+			gap = min(gap, times[k+1]-times[k])
+		}
+		steps[k] = gap / 2 / float64((attempts+1)/2+1)
+	}
+	hadAccepted := len(filter.hashes) > 0
+	tried := slices.Clone(times)
+	accepted := make([]bool, len(frames))
+	for k, frame := range frames {
+		if accepted[k] = filter.accepts(frame.score, frame.hash); accepted[k] {
+			filter.add(frame.hash)
+		}
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		var pending []int
+		var seeks []float64
+		var candidateFiles []string
+		// +step, -step, +2*step, -2*step, ...
+		shift := float64(attempt/2 + 1)
+		if attempt%2 == 1 {
+			shift = -shift
+		}
+		for k := range frames {
+			if accepted[k] {
+				continue
+			}
+			// shifts are counted from the originally planned timestamp
+			seek := times[k] + shift*steps[k]
+			if seek < 0 || seek > duration-0.1 {
+				continue
+			}
+			pending = append(pending, k)
+			seeks = append(seeks, seek)
+			candidateFiles = append(candidateFiles, filepath.Join(destinationPath, fmt.Sprintf("candidate.%d.%d.png", k, attempt)))
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		if err = ExtractFrames(file, seeks, candidateFiles, keyframesOnly); err != nil {
+			// Replacements are optional, keeping the frames we have
+			log.Println(err)
+			err = nil
+			break
+		}
+		tried = append(tried, seeks...)
+		for i, k := range pending {
+			score, hash, err1 := filter.scoreFile(candidateFiles[i])
+			if err1 != nil {
+				log.Println(err1)
+				continue
+			}
+			ok := filter.accepts(score, hash)
+			if ok || score.Score > frames[k].score.Score {
+				if err1 = os.Rename(candidateFiles[i], frames[k].file); err1 != nil {
+					log.Println(err1)
+					continue
+				}
+				frames[k].time, frames[k].score, frames[k].hash = seeks[i], score, hash
+				if accepted[k] = ok; ok {
+					filter.add(hash)
+				}
+			}
+		}
+	}
+	var best = -1
+	var result []scoredFrame
+	for k, frame := range frames {
+		if accepted[k] {
+			result = append(result, frame)
+		} else if best < 0 || frame.score.Score > frames[best].score.Score {
+			best = k
+		}
+	}
+	minGap := max(0.5, duration/float64(len(times)+1)/4)
+	for round := 0; len(result) < len(times); round++ {
+		seeks := refillSeeks(tried, duration, len(times)-len(result), minGap)
+		if len(seeks) == 0 {
+			break
+		}
+		var refillFiles []string
+		for i := range seeks {
+			refillFiles = append(refillFiles, filepath.Join(destinationPath, fmt.Sprintf("refill.%d.%d.png", round, i)))
+		}
+		if err = ExtractFrames(file, seeks, refillFiles, keyframesOnly); err != nil {
+			// Refill is optional, keeping the frames we have
+			log.Println(err)
+			err = nil
+			break
+		}
+		tried = append(tried, seeks...)
+		for i, refillFile := range refillFiles {
+			frame := scoredFrame{file: refillFile, time: seeks[i]}
+			var err1 error
+			if frame.score, frame.hash, err1 = filter.scoreFile(refillFile); err1 != nil {
+				log.Println(err1)
+				continue
+			}
+			if filter.accepts(frame.score, frame.hash) {
+				filter.add(frame.hash)
+				result = append(result, frame)
+			}
+		}
+	}
+	slices.SortFunc(result, func(a, b scoredFrame) int {
+		return cmp.Compare(a.time, b.time)
+	})
+	if len(result) == 0 && !hadAccepted {
+		log.Printf("no frames of %s pass quality thresholds, keeping the best one", filepath.Base(file))
+		result = append(result, frames[best])
+		filter.add(frames[best].hash)
+	}
+	return result, nil
+}
+
+// refillSeeks returns up to amount timestamps in the middle of the largest gaps between the tried timestamps
+// and the video bounds, skipping gaps shorter than 2*minGap
+func refillSeeks(tried []float64, duration float64, amount int, minGap float64) (seeks []float64) {
+	bounds := append([]float64{0, duration - 0.1}, tried...)
+	slices.Sort(bounds)
+	type gap struct {
+		from, to float64
+	}
+	var gaps []gap
+	for k := 1; k < len(bounds); k++ {
+		if bounds[k]-bounds[k-1] >= 2*minGap {
+			gaps = append(gaps, gap{from: bounds[k-1], to: bounds[k]})
+		}
+	}
+	slices.SortStableFunc(gaps, func(a, b gap) int {
+		return cmp.Compare(b.to-b.from, a.to-a.from)
+	})
+	for _, g := range gaps[:min(amount, len(gaps))] {
+		seeks = append(seeks, (g.from+g.to)/2)
+	}
+	slices.Sort(seeks)
+	return
+}
+
+// extractFramesAt extracts one frame exactly at each of the timestamps, in order. Timestamps at or after the end
+// of the video are moved just before it, when the video stream ends earlier its last frame is taken.
+// Frames are scored with the filter enabled, but never rejected.
+func extractFramesAt(file string, destinationPath string, timestamps []types.Timestamp, filter *frameFilter) (frames []scoredFrame, err error) {
+	fileFormat, err := probeFile(file)
+	if err != nil {
+		return
+	}
+	duration, _ := strconv.ParseFloat(fileFormat.Format.Duration, 64)
+	var seeks []float64
+	var frameFiles []string
+	for k, timestamp := range timestamps {
+		// there is no frame at the end of the video ("100%") and after it, taking the last one
+		seek := max(0, min(timestamp.At(duration), duration-0.1))
+		seeks = append(seeks, seek)
+		frameFiles = append(frameFiles, filepath.Join(destinationPath, "frame."+strconv.Itoa(k)+".png"))
+	}
+	// exactly the frame at the timestamp, not the largest of the following ones
+	missing, err := extractFrames(file, seeks, frameFiles, false, 1)
+	if err != nil {
+		return
+	}
+	for _, k := range missing {
+		// the video stream may end before the container duration
+		if err = extractLastFrame(file, frameFiles[k]); err != nil {
+			return
+		}
+	}
+	for k, frameFile := range frameFiles {
+		frame := scoredFrame{file: frameFile, time: seeks[k]}
+		if filter.quality.Enabled() {
+			if frame.score, _, err = filter.scoreFile(frameFile); err != nil {
+				return
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return
+}
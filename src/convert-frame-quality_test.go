@@ -0,0 +1,20 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRefillSeeks(t *testing.T) {
+	seeks := refillSeeks([]float64{20, 40, 60}, 100.1, 2, 2)
+	if !slices.Equal(seeks, []float64{10, 80}) {
+		t.Errorf("expected seeks in the largest gaps at 10 and 80, got %v", seeks)
+	}
+	seeks = refillSeeks([]float64{20, 22, 24}, 26.1, 5, 2)
+	if !slices.Equal(seeks, []float64{10}) {
+		t.Errorf("expected only the gap before 20 to be refilled, got %v", seeks)
+	}
+	if seeks = refillSeeks([]float64{1, 2, 3}, 4.1, 5, 1); len(seeks) != 0 {
+		t.Errorf("expected no seeks when the video runs out, got %v", seeks)
+	}
+}
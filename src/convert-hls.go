@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/types"
+)
+
+type hlsSegment struct {
+	uri      string
+	duration float64
+}
+
+type hlsKey struct {
+	key []byte
+	uri string
+}
+
+type hlsIFrame struct {
+	uri    string
+	time   float64
+	offset int64
+	length int64
+}
+
+// newHLSKey generates random AES-128 content key. The key is stored apart from the video,
+// so HLSKeyURI pointing players to it is required.
+func newHLSKey(format types.VideoFormatShort) (key *hlsKey, err error) {
+	if format.HLSKeyURI == "" {
+		err = errors.New("hls key uri is required for encrypted hls")
+		return
+	}
+	key = &hlsKey{key: make([]byte, 16), uri: strings.ReplaceAll(format.HLSKeyURI, "%NAME%", format.Name)}
+	if _, err = rand.Read(key.key); err != nil {
+		err = errors.Wrap(err, "can't generate hls key")
+	}
+	return
+}
+
+// write writes the key into keyFile and ffmpeg -hls_key_info_file into keyInfoFile,
+// ffmpeg encrypts segments and adds EXT-X-KEY tags itself. Until publish the tags point to the local keyFile
+// next to the playlist, so posters, timeline and the rest can still read the encrypted video.
+func (k *hlsKey) write(keyFile string, keyInfoFile string) error {
+	if err := os.WriteFile(keyFile, k.key, 0600); err != nil {
+		return errors.Wrap(err, "can't write hls key file")
+	}
+	if err := os.WriteFile(keyInfoFile, []byte(filepath.Base(keyFile)+"\n"+keyFile+"\n"), 0600); err != nil {
+		return errors.Wrap(err, "can't write hls key info file")
+	}
+	return nil
+}
+
+// publish points EXT-X-KEY tags of the playlist written with keyFile to the key uri
+func (k *hlsKey) publish(playlistFile string, keyFile string) error {
+	contents, err := os.ReadFile(playlistFile)
+	if err != nil {
+		return errors.Wrap(err, "can't read hls playlist")
+	}
+	contents = bytes.ReplaceAll(contents, []byte(`URI="`+filepath.Base(keyFile)+`"`), []byte(`URI="`+k.uri+`"`))
+	if err = os.WriteFile(playlistFile, contents, 0644); err != nil {
+		return errors.Wrap(err, "can't write hls playlist")
+	}
+	return nil
+}
+
+// CreateHLSPlaylists writes I-frame only playlist iframes-<name>.m3u8 for fast scrubbing and
+// master-<name>.m3u8 referencing both media and I-frame playlists.
+// Encrypted I-frame byte ranges can't be decrypted on their own, as every range restarts the CBC chain,
+// so no I-frame playlist is written for encrypted video and iframesCreated is false.
+func CreateHLSPlaylists(playlistFile string, targetPath string, info types.ContentVideoInfo, format types.VideoFormatShort, encrypted bool) (iframesCreated bool, err error) {
+	segments, err := readHLSPlaylist(playlistFile)
+	if err != nil {
+		return
+	}
+	if len(segments) == 0 {
+		err = errors.New("no segments in hls playlist " + filepath.Base(playlistFile))
+		return
+	}
+	var iframes []hlsIFrame
+	var totalDuration float64
+	var totalSize int64
+	for _, segment := range segments {
+		segmentFile := filepath.Join(filepath.Dir(playlistFile), segment.uri)
+		if !encrypted {
+			var segmentIFrames []hlsIFrame
+			segmentIFrames, err = readSegmentIFrames(segmentFile)
+			if err != nil {
+				return
+			}
+			for k := range segmentIFrames {
+				segmentIFrames[k].uri = segment.uri
+			}
+			iframes = append(iframes, segmentIFrames...)
+		}
+		totalDuration += segment.duration
+		if fi, err := os.Stat(segmentFile); err == nil {
+			totalSize += fi.Size()
+		}
+	}
+	if totalDuration <= 0 {
+		totalDuration = info.Duration
+	}
+	resolution := fmt.Sprintf("%dx%d", info.Size.Width, info.Size.Height)
+	masterPlaylist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:4\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%s\n%s\n",
+		int64(float64(totalSize*8)/totalDuration), resolution, filepath.Base(playlistFile))
+	if !encrypted {
+		if len(iframes) == 0 {
+			err = errors.New("no keyframes found in hls segments")
+			return
+		}
+		var iframesFile string
+		var iframesSize int64
+		iframesFile, iframesSize, err = writeIFramesPlaylist(iframes, totalDuration, targetPath, format)
+		if err != nil {
+			return
+		}
+		masterPlaylist += fmt.Sprintf("#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%s,URI=\"%s\"\n",
+			int64(float64(iframesSize*8)/totalDuration), resolution, iframesFile)
+		iframesCreated = true
+	}
+	err = os.WriteFile(filepath.Join(targetPath, fmt.Sprintf("master-%s.m3u8", format.Name)), []byte(masterPlaylist), 0644)
+	if err != nil {
+		err = errors.Wrap(err, "can't write master playlist")
+	}
+	return
+}
+
+// writeIFramesPlaylist writes iframes-<name>.m3u8 with byte ranges of the keyframes
+func writeIFramesPlaylist(iframes []hlsIFrame, totalDuration float64, targetPath string, format types.VideoFormatShort) (iframesFile string, iframesSize int64, err error) {
+	var iframesContents strings.Builder
+	var targetDuration float64
+	for k, iframe := range iframes {
+		var duration float64
+		if k < len(iframes)-1 {
+			duration = iframes[k+1].time - iframe.time
+		} else {
+			duration = totalDuration - (iframe.time - iframes[0].time)
+		}
+		targetDuration = math.Max(targetDuration, duration)
+		iframesSize += iframe.length
+		iframesContents.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n#EXT-X-BYTERANGE:%d@%d\n%s\n",
+			duration, iframe.length, iframe.offset, iframe.uri))
+	}
+	iframesPlaylist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n"+
+		"#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-I-FRAMES-ONLY\n%s#EXT-X-ENDLIST\n",
+		int(math.Ceil(targetDuration)), iframesContents.String())
+	iframesFile = fmt.Sprintf("iframes-%s.m3u8", format.Name)
+	err = os.WriteFile(filepath.Join(targetPath, iframesFile), []byte(iframesPlaylist), 0644)
+	if err != nil {
+		err = errors.Wrap(err, "can't write i-frame playlist")
+	}
+	return
+}
+
+func readHLSPlaylist(playlistFile string) (segments []hlsSegment, err error) {
+	var f *os.File
+	f, err = os.Open(playlistFile)
+	if err != nil {
+		err = errors.Wrap(err, "can't open hls playlist")
+		return
+	}
+	defer f.Close()
+	var duration float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#EXTINF:") {
+			duration, _ = strconv.ParseFloat(strings.TrimSuffix(strings.Split(strings.TrimPrefix(line, "#EXTINF:"), ",")[0], ","), 64)
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		segments = append(segments, hlsSegment{uri: line, duration: duration})
+		duration = 0
+	}
+	err = scanner.Err()
+	return
+}
+
+// readSegmentIFrames returns byte ranges of keyframes in the mpeg-ts segment.
+// Keyframe range lasts till the next video packet, so it includes interleaved audio but never the next frame.
+// The range of the keyframe opening the segment starts at zero to include PAT/PMT tables.
+func readSegmentIFrames(segmentFile string) (iframes []hlsIFrame, err error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,pos,flags", "-of", "csv=p=0", segmentFile)
+	var out []byte
+	out, err = cmd.Output()
+	if err != nil {
+		err = errors.Wrap(err, "can't read packets of "+filepath.Base(segmentFile))
+		return
+	}
+	fi, err := os.Stat(segmentFile)
+	if err != nil {
+		return
+	}
+	var current *hlsIFrame
+	var seenVideo bool
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Split(strings.TrimSpace(line), ",")
+		if len(parts) < 3 {
+			continue
+		}
+		pos, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if current != nil {
+			current.length = pos - current.offset
+			iframes = append(iframes, *current)
+			current = nil
+		}
+		if strings.HasPrefix(parts[2], "K") {
+			t, _ := strconv.ParseFloat(parts[0], 64)
+			current = &hlsIFrame{time: t, offset: pos}
+			if len(iframes) == 0 && !seenVideo {
+				current.offset = 0
+			}
+		}
+		seenVideo = true
+	}
+	if current != nil {
+		current.length = fi.Size() - current.offset
+		iframes = append(iframes, *current)
+	}
+	return
+}
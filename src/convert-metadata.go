@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/totaltube/conversion/types"
+)
+
+// metadataArgs returns ffmpeg output options dropping source metadata, chapters and encoder strings
+// unless metadata.Keep is set, followed by the custom tags
+func metadataArgs(metadata types.OutputMetadata) (args []string) {
+	if !metadata.Keep {
+		args = append(args,
+			"-map_metadata", "-1",
+			"-map_metadata:s:v", "-1",
+			"-map_metadata:s:a", "-1",
+			"-map_chapters", "-1",
+			"-fflags", "+bitexact",
+			"-flags:v", "+bitexact",
+			"-flags:a", "+bitexact")
+	}
+	for _, tag := range [][2]string{
+		{"title", metadata.Title},
+		{"comment", metadata.Comment},
+		{"copyright", metadata.Copyright},
+		{"content_id", metadata.ContentID},
+	} {
+		if tag[1] != "" {
+			args = append(args, "-metadata", tag[0]+"="+tag[1])
+		}
+	}
+	return
+}
+
+// movflagsArgs returns -movflags for mp4/mov outputs. Custom tags like content_id
+// are written to mp4 only with use_metadata_tags.
+func movflagsArgs(videoType string, metadata types.OutputMetadata) []string {
+	if videoType != "mp4" && videoType != "mov" {
+		return nil
+	}
+	if metadata.ContentID != "" {
+		return []string{"-movflags", "faststart+use_metadata_tags"}
+	}
+	return []string{"-movflags", "faststart"}
+}
+
+// shellJoin quotes args for the bash command line
+func shellJoin(args []string) string {
+	var quoted = make([]string, len(args))
+	for k, arg := range args {
+		quoted[k] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
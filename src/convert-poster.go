@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
+)
+
+// createPoster extracts poster-<name>.<type> from the video into targetPath.
+// With PosterCandidates set the sharpest well exposed frame of the evenly sampled ones is used.
+func createPoster(videoFile string, tempPath string, targetPath string, duration float64, format types.VideoFormatShort, info *types.ContentVideoInfo) (err error) {
+	posterFile := filepath.Join(targetPath, fmt.Sprintf("poster-%s.%s", format.Name, format.PosterType))
+	var tempFile string
+	var posterTime float64
+	var score helpers.ImageScore
+	if format.PosterCandidates > 1 {
+		tempFile, posterTime, score, err = bestPosterFrame(videoFile, tempPath, duration, format)
+		if err != nil {
+			return
+		}
+	} else {
+		var seekPercent = rand.Float64()*(format.PosterTimeRange[1]-format.PosterTimeRange[0]) + format.PosterTimeRange[0]
+		posterTime = duration * seekPercent / 100
+		tempFile = filepath.Join(tempPath, "poster.png")
+		err = ExtractFrame(videoFile, time.Duration(float64(time.Second)*posterTime), tempFile)
+		if err != nil {
+			log.Println(err)
+			err = errors.Wrap(err, "can't extract poster from result video")
+			return
+		}
+		score, _ = helpers.ScoreImageFile(tempFile)
+	}
+	if len(format.PosterSizes) > 0 {
+		err = createPosterSizes(tempFile, targetPath, format, info)
+		if err != nil {
+			return
+		}
+	}
+	if err = posterPlaceholder(tempFile, info); err != nil {
+		log.Println(err)
+		err = errors.Wrap(err, "poster placeholder create error")
+		return
+	}
+	if format.PosterType == "png" {
+		err = os.Rename(tempFile, posterFile)
+		if err != nil {
+			log.Println(err)
+			err = errors.Wrap(err, "poster create error")
+			return
+		}
+	} else {
+		err = ConvertImage(tempFile, posterCommand(format), posterFile, "")
+		if err != nil {
+			log.Println(err)
+			err = errors.Wrap(err, "poster create error")
+			return
+		}
+	}
+	info.PosterType = format.PosterType
+	info.PosterTime = posterTime
+	info.PosterScore = score.Score
+	return
+}
+
+// bestPosterFrame extracts PosterCandidates frames evenly spread over PosterTimeRange and returns the best scored one
+func bestPosterFrame(videoFile string, tempPath string, duration float64, format types.VideoFormatShort) (bestFile string, bestTime float64, bestScore helpers.ImageScore, err error) {
+	candidatesPath := filepath.Join(tempPath, "poster-candidates")
+	_ = os.MkdirAll(candidatesPath, os.ModePerm)
+	from := duration * format.PosterTimeRange[0] / 100
+	to := duration * format.PosterTimeRange[1] / 100
+	step := (to - from) / float64(format.PosterCandidates)
+	var times []float64
+	var candidateFiles []string
+	for k := 0; k < int(format.PosterCandidates); k++ {
+		// middle of each interval, so the candidates never hit the range borders
+		times = append(times, from+step*(float64(k)+0.5))
+		candidateFiles = append(candidateFiles, filepath.Join(candidatesPath, fmt.Sprintf("%d.png", k)))
+	}
+	err = ExtractFrames(videoFile, times, candidateFiles, false)
+	if err != nil {
+		log.Println(err)
+		err = errors.Wrap(err, "can't extract poster candidates from result video")
+		return
+	}
+	bestScore.Score = -1
+	for k, candidateFile := range candidateFiles {
+		var score helpers.ImageScore
+		score, err = helpers.ScoreImageFile(candidateFile)
+		if err != nil {
+			return
+		}
+		if score.Score > bestScore.Score {
+			bestFile, bestTime, bestScore = candidateFile, times[k], score
+		}
+	}
+	if bestFile == "" {
+		err = errors.New("no poster candidates extracted")
+	}
+	return
+}
+
+// posterCommand returns PosterCommand or the default imagemagick command for the poster type
+func posterCommand(format types.VideoFormatShort) string {
+	if format.PosterCommand != "" {
+		return format.PosterCommand
+	}
+	switch format.PosterType {
+	case "webp":
+		return "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% -quality 92 %RESULT_FILE%"
+	case "png":
+		return "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% %RESULT_FILE%"
+	}
+	return "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% -quality 84 %RESULT_FILE%"
+}
+
+// createPosterSizes writes poster-<name>-<W>x<H>.<type> for each of PosterSizes.
+// Like thumbnails, @2x variants are created for all sizes or for none, depending on the frame size.
+func createPosterSizes(frameFile string, targetPath string, format types.VideoFormatShort, info *types.ContentVideoInfo) error {
+	frameWidth, frameHeight, err := helpers.GetImageDimensions(frameFile)
+	if err != nil {
+		return errors.Wrap(err, "can't read poster frame size")
+	}
+	retina := format.PosterRetina
+	for _, size := range format.PosterSizes {
+		if frameWidth < int(size.Width)*2 || frameHeight < int(size.Height)*2 {
+			retina = false
+		}
+	}
+	command := posterCommand(format)
+	for _, size := range format.PosterSizes {
+		name := fmt.Sprintf("poster-%s-%dx%d", format.Name, size.Width, size.Height)
+		err = ConvertImage(frameFile, command, filepath.Join(targetPath, name+"."+format.PosterType),
+			fmt.Sprintf("%dx%d", size.Width, size.Height))
+		if err != nil {
+			log.Println(err)
+			return errors.Wrap(err, "poster create error")
+		}
+		if retina {
+			err = ConvertImage(frameFile, command, filepath.Join(targetPath, name+"@2x."+format.PosterType),
+				fmt.Sprintf("%dx%d", size.Width*2, size.Height*2))
+			if err != nil {
+				log.Println(err)
+				return errors.Wrap(err, "retina poster create error")
+			}
+		}
+	}
+	info.PosterSizes = format.PosterSizes
+	info.PosterRetina = retina
+	return nil
+}
+
+// posterPlaceholder fills blurhash and dominant color of the poster frame
+func posterPlaceholder(frameFile string, info *types.ContentVideoInfo) error {
+	im, err := helpers.DecodeImageFile(frameFile)
+	if err != nil {
+		return errors.Wrap(err, "can't decode poster frame")
+	}
+	info.PosterBlurHash = helpers.BlurHash(im, 4, 3)
+	info.PosterColor = helpers.DominantColor(im)
+	return nil
+}
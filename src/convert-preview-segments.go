@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/types"
+)
+
+// activityFPS is the frame rate the video is sampled with to score preview segments
+const activityFPS = 2
+
+// minPreviewSegmentDuration is the shortest segment adapted plans of short videos may use
+const minPreviewSegmentDuration = 1.0
+
+// activitySample is motion and brightness of the video at the moment
+type activitySample struct {
+	time       float64
+	scene      float64
+	brightness float64
+}
+
+// planPreviewSegments chooses segmentsCount segments of segmentDuration seconds for the video preview.
+// Evenly spread segments overlap when the video is shorter than segmentsCount+1 segments, for such videos
+// the plan is adapted. A video not shorter than the requested preview duration (segmentsCount×segmentDuration)
+// is played whole, sped up to fit it but not more than twice. Shorter videos use fewer segments, then shorter ones
+// (not shorter than minPreviewSegmentDuration), at last the whole video is played with normal speed.
+func planPreviewSegments(sourceFile string, tempPath string, duration float64, segmentsCount int64, segmentDuration float64, format types.ThumbFormatShort) (plan types.PreviewPlan, err error) {
+	if segmentsCount <= 0 || segmentDuration <= 0 {
+		err = errors.New("segments count and duration are required for video preview")
+		return
+	}
+	plan.Speed = 1
+	fits := func(length float64, count int64, d float64) bool {
+		return length >= d*float64(count+1)
+	}
+	from := duration * math.Max(0, format.SkipIntroPercent) / 100
+	to := duration * (1 - math.Max(0, format.SkipOutroPercent)/100)
+	if !fits(to-from, segmentsCount, segmentDuration) {
+		// Skipping intro and outro leaves not enough video
+		from, to = 0, duration
+	}
+	if !fits(to-from, segmentsCount, segmentDuration) {
+		target := segmentDuration * float64(segmentsCount)
+		if duration >= target {
+			plan.Adaptation = "whole_clip"
+			plan.Speed = math.Max(1, math.Min(2, duration/target))
+			plan.Segments = []types.PreviewSegment{{Start: 0, Duration: duration}}
+			return
+		}
+		if count := int64(duration/segmentDuration) - 1; count >= min(2, segmentsCount) && count < segmentsCount {
+			plan.Adaptation = "fewer_segments"
+			segmentsCount = count
+		} else if d := duration / float64(segmentsCount+1); d >= minPreviewSegmentDuration {
+			plan.Adaptation = "shorter_segments"
+			segmentDuration = d
+		} else {
+			plan.Adaptation = "whole_clip"
+			plan.Segments = []types.PreviewSegment{{Start: 0, Duration: duration}}
+			return
+		}
+	}
+	switch format.SegmentSelection {
+	case "", "even":
+		plan.Segments = evenSegments(from, to, segmentsCount, segmentDuration)
+	case "scored":
+		plan.Segments, err = scoredSegments(sourceFile, tempPath, from, to, segmentsCount, segmentDuration)
+	default:
+		err = errors.New("unknown segment selection " + format.SegmentSelection)
+	}
+	return
+}
+
+// evenSegments spreads segments evenly over the range with a small random offset
+func evenSegments(from float64, to float64, segmentsCount int64, segmentDuration float64) (segments []types.PreviewSegment) {
+	// Распределяем равномерно по длительности видео
+	interval := (to - from) / float64(segmentsCount+1)
+	for i := range segmentsCount {
+		// Добавляем небольшую рандомизацию чтобы сегменты не были слишком предсказуемыми
+		randomOffset := rand.Float64() * interval * 0.3 // ±15% от интервала
+		seekTime := from + interval*float64(i+1) + randomOffset
+		if seekTime+segmentDuration > to {
+			seekTime = to - segmentDuration
+		}
+		if seekTime < from {
+			seekTime = from
+		}
+		segments = append(segments, types.PreviewSegment{Start: seekTime, Duration: segmentDuration})
+	}
+	return
+}
+
+// scoredSegments scores candidate windows by scene change activity and brightness
+// and returns the best non-overlapping ones in chronological order
+func scoredSegments(sourceFile string, tempPath string, from float64, to float64, segmentsCount int64, segmentDuration float64) ([]types.PreviewSegment, error) {
+	samples, err := analyzeActivity(sourceFile, tempPath)
+	if err != nil {
+		return nil, err
+	}
+	segments := selectScoredSegments(samples, from, to, segmentsCount, segmentDuration)
+	if int64(len(segments)) < segmentsCount {
+		log.Printf("only %d of %d scored segments found, using even selection", len(segments), segmentsCount)
+		return evenSegments(from, to, segmentsCount, segmentDuration), nil
+	}
+	return segments, nil
+}
+
+// selectScoredSegments slides the window over the samples, scores the windows and picks up to segmentsCount
+// best non-overlapping ones, sorted by start
+func selectScoredSegments(samples []activitySample, from float64, to float64, segmentsCount int64, segmentDuration float64) []types.PreviewSegment {
+	samples = slices.Clone(samples)
+	slices.SortFunc(samples, func(a, b activitySample) int {
+		return cmp.Compare(a.time, b.time)
+	})
+	// prefix sums make each window sum O(1)
+	sceneSums := make([]float64, len(samples)+1)
+	brightnessSums := make([]float64, len(samples)+1)
+	for k, sample := range samples {
+		sceneSums[k+1] = sceneSums[k] + sample.scene
+		brightnessSums[k+1] = brightnessSums[k] + sample.brightness
+	}
+	type window struct {
+		start float64
+		score float64
+	}
+	var windows []window
+	var first, last int
+	step := math.Max(0.5, segmentDuration/2)
+	for start := from; start+segmentDuration <= to; start += step {
+		// samples[first:last] are the ones within [start, start+segmentDuration)
+		for first < len(samples) && samples[first].time < start {
+			first++
+		}
+		last = max(last, first)
+		for last < len(samples) && samples[last].time < start+segmentDuration {
+			last++
+		}
+		count := last - first
+		if count == 0 {
+			continue
+		}
+		scene := (sceneSums[last] - sceneSums[first]) / float64(count)
+		brightness := (brightnessSums[last] - brightnessSums[first]) / float64(count)
+		// Dark and washed out windows are penalized, static ones still beat black screens
+		brightnessFactor := 1.0
+		if brightness < 0.15 {
+			brightnessFactor = brightness / 0.15
+		} else if brightness > 0.9 {
+			brightnessFactor = (1 - brightness) / 0.1
+		}
+		windows = append(windows, window{start: start, score: (0.05 + scene) * brightnessFactor})
+	}
+	slices.SortStableFunc(windows, func(a, b window) int {
+		return cmp.Compare(b.score, a.score)
+	})
+	var segments []types.PreviewSegment
+	for _, w := range windows {
+		if int64(len(segments)) >= segmentsCount {
+			break
+		}
+		overlaps := false
+		for _, s := range segments {
+			if w.start < s.Start+s.Duration && s.Start < w.start+segmentDuration {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			segments = append(segments, types.PreviewSegment{Start: w.start, Duration: segmentDuration})
+		}
+	}
+	slices.SortFunc(segments, func(a, b types.PreviewSegment) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	return segments
+}
+
+// analyzeActivity samples the video with activityFPS and returns scene change score and mean brightness of each frame
+func analyzeActivity(sourceFile string, tempPath string) (samples []activitySample, err error) {
+	metadataFile := filepath.Join(tempPath, "preview_activity.txt")
+	defer os.Remove(metadataFile)
+	cmd := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error", "-i", sourceFile, "-an", "-sn",
+		"-vf", fmt.Sprintf("fps=%d,scale=160:-2,signalstats,select='gte(scene,0)',metadata=mode=print:file=%s",
+			activityFPS, strings.ReplaceAll(metadataFile, ":", `\:`)),
+		"-f", "null", "-")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Println(string(out))
+		err = errors.Wrap(err, "can't analyze video activity")
+		return
+	}
+	f, err := os.Open(metadataFile)
+	if err != nil {
+		err = errors.Wrap(err, "can't read video activity")
+		return
+	}
+	defer f.Close()
+	var current *activitySample
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "frame:") {
+			if current != nil {
+				samples = append(samples, *current)
+			}
+			current = &activitySample{}
+			if i := strings.Index(line, "pts_time:"); i >= 0 {
+				if fields := strings.Fields(line[i+len("pts_time:"):]); len(fields) > 0 {
+					current.time, _ = strconv.ParseFloat(fields[0], 64)
+				}
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "lavfi.scene_score":
+			current.scene, _ = strconv.ParseFloat(value, 64)
+		case "lavfi.signalstats.YAVG":
+			yavg, _ := strconv.ParseFloat(value, 64)
+			current.brightness = yavg / 255
+		}
+	}
+	if current != nil {
+		samples = append(samples, *current)
+	}
+	err = scanner.Err()
+	return
+}
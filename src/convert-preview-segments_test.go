@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/totaltube/conversion/types"
+)
+
+func TestPlanPreviewSegmentsAdaptation(t *testing.T) {
+	var format types.ThumbFormatShort
+	for _, c := range []struct {
+		duration        float64
+		segmentsCount   int64
+		segmentDuration float64
+		adaptation      string
+		speed           float64
+		// starts are the earliest starts of the segments, evenly spread ones are shifted up to jitter forward
+		starts []float64
+		jitter float64
+	}{
+		{duration: 120, segmentsCount: 5, segmentDuration: 2, adaptation: "", speed: 1,
+			starts: []float64{20, 40, 60, 80, 100}, jitter: 6},
+		{duration: 11, segmentsCount: 5, segmentDuration: 2, adaptation: "whole_clip", speed: 1.1, starts: []float64{0}},
+		{duration: 8, segmentsCount: 5, segmentDuration: 2, adaptation: "fewer_segments", speed: 1,
+			starts: []float64{2, 4, 6}, jitter: 0.6},
+		{duration: 15, segmentsCount: 3, segmentDuration: 10, adaptation: "shorter_segments", speed: 1,
+			starts: []float64{3.75, 7.5, 11.25}, jitter: 1.125},
+		{duration: 2, segmentsCount: 5, segmentDuration: 2, adaptation: "whole_clip", speed: 1, starts: []float64{0}},
+	} {
+		plan, err := planPreviewSegments("", "", c.duration, c.segmentsCount, c.segmentDuration, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.Adaptation != c.adaptation || len(plan.Segments) != len(c.starts) {
+			t.Errorf("duration %.0f: expected %d segments with %q adaptation, got %d with %q",
+				c.duration, len(c.starts), c.adaptation, len(plan.Segments), plan.Adaptation)
+			continue
+		}
+		if math.Abs(plan.Speed-c.speed) > 1e-9 {
+			t.Errorf("duration %.0f: expected speed %v, got %v", c.duration, c.speed, plan.Speed)
+		}
+		for k, segment := range plan.Segments {
+			if segment.Start < c.starts[k]-1e-9 || segment.Start > c.starts[k]+c.jitter+1e-9 {
+				t.Errorf("duration %.0f: segment %d starts at %v, expected %v..%v",
+					c.duration, k, segment.Start, c.starts[k], c.starts[k]+c.jitter)
+			}
+			if segment.Start < 0 || segment.Start+segment.Duration > c.duration+1e-9 {
+				t.Errorf("duration %.0f: segment %+v is out of the video", c.duration, segment)
+			}
+		}
+	}
+}
+
+func TestSelectScoredSegments(t *testing.T) {
+	var samples []activitySample
+	for k := 0; k < 60*activityFPS; k++ {
+		sample := activitySample{time: float64(k) / activityFPS, brightness: 0.5}
+		switch {
+		case sample.time >= 40 && sample.time < 44:
+			sample.scene = 0.8
+		case sample.time >= 10 && sample.time < 14:
+			sample.scene = 0.5
+		case sample.time >= 30 && sample.time < 34:
+			// active but almost black
+			sample.scene, sample.brightness = 0.9, 0.01
+		}
+		samples = append(samples, sample)
+	}
+	segments := selectScoredSegments(samples, 0, 60, 2, 4)
+	if len(segments) != 2 || segments[0].Start != 10 || segments[1].Start != 40 {
+		t.Fatalf("expected segments at 10 and 40, got %+v", segments)
+	}
+	for _, segment := range segments {
+		if segment.Duration != 4 {
+			t.Errorf("expected segment duration 4, got %+v", segment)
+		}
+	}
+}
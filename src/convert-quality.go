@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/types"
+)
+
+var qualityScoreRegexps = map[string]*regexp.Regexp{
+	"vmaf": regexp.MustCompile(`VMAF score[:=]\s*([\d.]+)`),
+	"ssim": regexp.MustCompile(`SSIM .*All:([\d.]+)`),
+	"psnr": regexp.MustCompile(`PSNR .*average:([\d.]+|inf)`),
+}
+
+var ffmpegFilters string
+var ffmpegFiltersOnce sync.Once
+
+// ffmpegHasFilter checks if installed ffmpeg is built with the filter
+func ffmpegHasFilter(name string) bool {
+	ffmpegFiltersOnce.Do(func() {
+		out, err := exec.Command("ffmpeg", "-hide_banner", "-filters").CombinedOutput()
+		if err != nil {
+			log.Println("can't get list of ffmpeg filters:", err)
+		}
+		ffmpegFilters = string(out)
+	})
+	for _, line := range strings.Split(ffmpegFilters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckVideoQuality compares the encoded video with its source on a few sampled segments
+func CheckVideoQuality(sourceFile string, resultFile string, duration float64, format types.VideoFormatShort) (quality types.VideoQuality, err error) {
+	quality.Metric, quality.RequestedMetric, err = qualityMetric(format, ffmpegHasFilter)
+	if err != nil {
+		return
+	}
+	var sourceFormat, resultFormat types.FileFormat
+	if sourceFormat, err = probeFile(sourceFile); err != nil {
+		return
+	}
+	if resultFormat, err = probeFile(resultFile); err != nil {
+		return
+	}
+	sourceVideo, _ := probeStreams(sourceFormat)
+	resultVideo, _ := probeStreams(resultFormat)
+	if sourceVideo == nil || resultVideo == nil {
+		err = errors.New("can't find video streams to compare quality")
+		return
+	}
+	// Reference goes through the same crop as the output, then is scaled to the exact output size
+	var referenceFilter = ""
+	if format.Crop && !videoSizeOk(format, sourceVideo.Width, sourceVideo.Height) {
+		referenceFilter = scaleFilter(format, sourceVideo.Width, sourceVideo.Height) + ","
+	}
+	referenceFilter += fmt.Sprintf("scale=%d:%d:flags=bicubic", resultVideo.Width, resultVideo.Height)
+	samples := int(format.QualitySamples)
+	if samples <= 0 {
+		samples = 3
+	}
+	sampleDuration := format.QualitySampleDuration
+	if sampleDuration <= 0 {
+		sampleDuration = 5
+	}
+	if sampleDuration*float64(samples) > duration {
+		samples = 1
+		sampleDuration = duration
+	}
+	var total float64
+	for i := 0; i < samples; i++ {
+		start := (duration - sampleDuration) * float64(i+1) / float64(samples+1)
+		if samples == 1 && sampleDuration == duration {
+			start = 0
+		}
+		ss := strconv.FormatFloat(start, 'f', 3, 64)
+		t := strconv.FormatFloat(sampleDuration, 'f', 3, 64)
+		filter := fmt.Sprintf("[0:v]setpts=PTS-STARTPTS,format=yuv420p[dist];[1:v]%s,setpts=PTS-STARTPTS,format=yuv420p[ref];[dist][ref]%s",
+			referenceFilter, qualityFilter(quality.Metric))
+		cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats",
+			"-ss", ss, "-t", t, "-i", resultFile,
+			"-ss", ss, "-t", t, "-i", sourceFile,
+			"-lavfi", filter, "-f", "null", "-")
+		var out []byte
+		out, err = cmd.CombinedOutput()
+		if err != nil {
+			log.Println(string(out))
+			err = errors.Wrap(err, "can't compute "+quality.Metric+" of result video")
+			return
+		}
+		matches := qualityScoreRegexps[quality.Metric].FindAllStringSubmatch(string(out), -1)
+		if len(matches) == 0 {
+			log.Println(string(out))
+			err = errors.New("can't find " + quality.Metric + " score in ffmpeg output")
+			return
+		}
+		var score float64
+		if matches[len(matches)-1][1] == "inf" {
+			// Identical frames
+			score = 100
+		} else {
+			score, _ = strconv.ParseFloat(matches[len(matches)-1][1], 64)
+		}
+		quality.Samples = append(quality.Samples, score)
+		total += score
+	}
+	quality.Score = math.Round(total/float64(len(quality.Samples))*1000) / 1000
+	return
+}
+
+// qualityMetric returns the metric to compute. When vmaf is requested but ffmpeg has no libvmaf filter
+// ssim is used and requested is set to vmaf. A vmaf threshold can't be checked by ssim, so the fallback
+// requires QualityMinSSIM when QualityMinVMAF is set.
+func qualityMetric(format types.VideoFormatShort, hasFilter func(name string) bool) (metric string, requested string, err error) {
+	metric = strings.ToLower(format.QualityMetric)
+	if metric == "" {
+		metric = "vmaf"
+	}
+	if _, ok := qualityScoreRegexps[metric]; !ok {
+		err = errors.New("unknown quality metric " + format.QualityMetric)
+		return
+	}
+	if metric == "vmaf" && !hasFilter("libvmaf") {
+		if format.QualityMinVMAF > 0 && format.QualityMinSSIM <= 0 {
+			err = errors.New("ffmpeg is built without libvmaf, quality_min_vmaf can't be checked: set quality_min_ssim for the ssim fallback")
+			return
+		}
+		log.Println("ffmpeg is built without libvmaf, using ssim for quality check")
+		metric, requested = "ssim", "vmaf"
+	}
+	return
+}
+
+// checkQualityThreshold fails when the score is below the threshold of the metric actually computed
+func checkQualityThreshold(quality types.VideoQuality, format types.VideoFormatShort) error {
+	if minScore := qualityThreshold(quality.Metric, format); minScore > 0 && quality.Score < minScore {
+		return fmt.Errorf("quality check failed for format %s: %s score %.3f is below %.3f",
+			format.Name, quality.Metric, quality.Score, minScore)
+	}
+	return nil
+}
+
+func qualityFilter(metric string) string {
+	switch metric {
+	case "vmaf":
+		return "libvmaf=n_threads=2"
+	case "psnr":
+		return "psnr"
+	}
+	return "ssim"
+}
+
+// qualityThreshold returns minimal allowed score of the metric for the format
+func qualityThreshold(metric string, format types.VideoFormatShort) float64 {
+	switch metric {
+	case "vmaf":
+		return format.QualityMinVMAF
+	case "psnr":
+		return format.QualityMinPSNR
+	}
+	return format.QualityMinSSIM
+}
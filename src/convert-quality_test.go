@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/totaltube/conversion/types"
+)
+
+func TestQualityMetricFallback(t *testing.T) {
+	withVMAF := func(string) bool { return true }
+	withoutVMAF := func(string) bool { return false }
+	metric, requested, err := qualityMetric(types.VideoFormatShort{QualityMinVMAF: 90}, withVMAF)
+	if err != nil || metric != "vmaf" || requested != "" {
+		t.Errorf("vmaf expected, got %q %q %v", metric, requested, err)
+	}
+	metric, requested, err = qualityMetric(types.VideoFormatShort{}, withoutVMAF)
+	if err != nil || metric != "ssim" || requested != "vmaf" {
+		t.Errorf("ssim fallback expected, got %q %q %v", metric, requested, err)
+	}
+	if _, _, err = qualityMetric(types.VideoFormatShort{QualityMinVMAF: 90}, withoutVMAF); err == nil {
+		t.Error("vmaf threshold without ssim threshold should fail on fallback")
+	}
+	metric, _, err = qualityMetric(types.VideoFormatShort{QualityMinVMAF: 90, QualityMinSSIM: 0.95}, withoutVMAF)
+	if err != nil || metric != "ssim" {
+		t.Errorf("ssim fallback with ssim threshold expected, got %q %v", metric, err)
+	}
+	if _, _, err = qualityMetric(types.VideoFormatShort{QualityMetric: "butteraugli"}, withVMAF); err == nil {
+		t.Error("unknown metric should fail")
+	}
+}
+
+func TestCheckQualityThreshold(t *testing.T) {
+	format := types.VideoFormatShort{QualityMinVMAF: 90, QualityMinSSIM: 0.95}
+	for _, c := range []struct {
+		quality types.VideoQuality
+		ok      bool
+	}{
+		{types.VideoQuality{Metric: "vmaf", Score: 92}, true},
+		{types.VideoQuality{Metric: "vmaf", Score: 85}, false},
+		{types.VideoQuality{Metric: "ssim", Score: 0.97, RequestedMetric: "vmaf"}, true},
+		{types.VideoQuality{Metric: "ssim", Score: 0.9, RequestedMetric: "vmaf"}, false},
+		{types.VideoQuality{Metric: "psnr", Score: 10}, true},
+	} {
+		if err := checkQualityThreshold(c.quality, format); (err == nil) != c.ok {
+			t.Errorf("%+v: expected ok=%v, got %v", c.quality, c.ok, err)
+		}
+	}
+}
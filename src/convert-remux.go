@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
+)
+
+// subtitleCodecs is the subtitle codec each container gets when subtitles are kept
+var subtitleCodecs = map[string]string{
+	"mp4":  "mov_text",
+	"mov":  "mov_text",
+	"webm": "webvtt",
+	"mkv":  "copy",
+}
+
+// RemuxVideo rewraps the source into video-<name>.<type> in targetPath without re-encoding.
+// Only the first video and audio streams are kept, data streams are dropped.
+func RemuxVideo(sourceFile string, targetPath string, format types.RemuxFormatShort) (info types.ContentVideoInfo, err error) {
+	if format.Type == "" {
+		format.Type = "mp4"
+	}
+	if _, ok := containerCodecs[format.Type]; !ok {
+		err = errors.New("remuxing into " + format.Type + " is not supported")
+		return
+	}
+	sourceFile, _ = filepath.Abs(sourceFile)
+	var fileFormat types.FileFormat
+	fileFormat, err = probeFile(sourceFile)
+	if err != nil {
+		return
+	}
+	videoStream, audioStream := probeStreams(fileFormat)
+	if videoStream == nil {
+		err = errors.New("no video stream in source file")
+		return
+	}
+	if !canCopyCodecs(format.Type, videoStream.CodecName, "") {
+		err = fmt.Errorf("video codec %s is not compatible with %s container, conversion is required", videoStream.CodecName, format.Type)
+		return
+	}
+	if format.NoAudio {
+		audioStream = nil
+	}
+	if audioStream != nil && !canCopyCodecs(format.Type, "", audioStream.CodecName) {
+		err = fmt.Errorf("audio codec %s is not compatible with %s container, conversion is required", audioStream.CodecName, format.Type)
+		return
+	}
+	resultFile := filepath.Join(targetPath, fmt.Sprintf("video-%s.%s", format.Name, format.Type))
+	args := []string{"-y", "-hide_banner", "-loglevel", "error", "-fflags", "+genpts", "-i", sourceFile,
+		"-map", "0:v:0", "-c:v", "copy"}
+	if audioStream != nil {
+		args = append(args, "-map", "0:a:0", "-c:a", "copy")
+		if audioStream.CodecName == "aac" && (format.Type == "mp4" || format.Type == "mov") {
+			// ADTS aac from mpeg-ts needs conversion of headers
+			args = append(args, "-bsf:a", "aac_adtstoasc")
+		}
+	}
+	if subtitleCodec, ok := subtitleCodecs[format.Type]; ok && format.KeepSubtitles {
+		args = append(args, "-map", "0:s?", "-c:s", subtitleCodec)
+	}
+	args = append(args, "-dn")
+	args = append(args, metadataArgs(format.Metadata)...)
+	args = append(args, movflagsArgs(format.Type, format.Metadata)...)
+	args = append(args, resultFile)
+	out, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		log.Println(string(out))
+		err = errors.Wrap(err, "can't remux video for format "+format.Name)
+		return
+	}
+	if !helpers.FileExists(resultFile) {
+		err = errors.New("result file " + resultFile + " not created during remuxing. Something is wrong.")
+		return
+	}
+	info, err = readVideoInfo(resultFile, types.VideoFormatShort{Name: format.Name, Type: format.Type})
+	if err != nil {
+		return
+	}
+	info.StreamCopy = true
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"image"
 	"log"
@@ -9,11 +10,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/rs/xid"
 
 	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
 )
 
 func CreateTimeline(files []string, workingPath string, format TimelineFormat) (resultFiles []string, err error) {
@@ -147,3 +150,150 @@ func CreateTimeline(files []string, workingPath string, format TimelineFormat) (
 	}
 	return
 }
+
+// defaultTimelineMaxSheetSize is the largest image dimension supported by webp
+const defaultTimelineMaxSheetSize = 16383
+
+// timelineTypes are supported types of timeline sheets
+var timelineTypes = []string{"jpg", "webp", "png"}
+
+// CreateVideoTimeline extracts frames from the video and combines them into timeline sprite sheets
+// with timeline-<name>.vtt referencing the frames by #xywh fragments.
+// Frames are laid out in rows of TimelineColumns, a single sheet is named timeline-<name>.<type>,
+// multiple sheets are timeline-<name>.<i>.<type>.
+func CreateVideoTimeline(videoFile string, tempPath string, targetPath string, duration float64, format types.VideoFormatShort, info *types.ContentVideoInfo) error {
+	if format.TimelineMaxAmount <= 0 && format.TimelineMinInterval <= 0 {
+		return errors.New("timeline max amount or min interval is required")
+	}
+	framesPath := filepath.Join(tempPath, "timeline")
+	_ = os.MkdirAll(framesPath, os.ModePerm)
+	times, err := doExtractFrames2(videoFile, framesPath, int64(format.TimelineMaxAmount), float64(format.TimelineMinInterval), false, false)
+	if err != nil {
+		return err
+	}
+	var matches []string
+	for k := 0; ; k++ {
+		m := filepath.Join(framesPath, fmt.Sprintf("frame.%d.png", k))
+		if !helpers.FileExists(m) {
+			break
+		}
+		matches = append(matches, m)
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	var cmd = "convert %SOURCE_FILE% -resize %SIZE% %RESULT_FILE%"
+	if format.TimelineCrop {
+		cmd = "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% %RESULT_FILE%"
+	}
+	var frames = make([]string, 0, len(matches))
+	var width, height int
+	for k, m := range matches {
+		frameFile := filepath.Join(framesPath, fmt.Sprintf("%d.png", k))
+		err = ConvertImage(m, cmd, frameFile, fmt.Sprintf("%dx%d", format.TimelineSize.Width, format.TimelineSize.Height))
+		_ = os.Remove(m)
+		if err != nil {
+			return errors.Wrap(err, "timeline frame conversion error")
+		}
+		if k == 0 {
+			width, height, err = helpers.GetImageDimensions(frameFile)
+			if err != nil {
+				return errors.Wrap(err, "error getting dimensions of timeline frame")
+			}
+		}
+		frames = append(frames, frameFile)
+	}
+	columns, rows := timelineGrid(len(frames), width, height, int(format.TimelineColumns), int(format.TimelineMaxSheetSize))
+	perSheet := columns * rows
+	sheets := (len(frames) + perSheet - 1) / perSheet
+	var sheetFiles = make([]string, sheets)
+	for i := range sheetFiles {
+		if sheets == 1 {
+			sheetFiles[i] = fmt.Sprintf("timeline-%s.%s", format.Name, format.TimelineType)
+		} else {
+			sheetFiles[i] = fmt.Sprintf("timeline-%s.%d.%s", format.Name, i, format.TimelineType)
+		}
+	}
+	var manifest = make([]types.TimelineFrame, len(frames))
+	var vttContents strings.Builder
+	vttContents.WriteString("WEBVTT\n\n")
+	for k := range frames {
+		position := k % perSheet
+		frame := types.TimelineFrame{
+			Time:   times[k],
+			Start:  times[k],
+			End:    duration,
+			Sheet:  sheetFiles[k/perSheet],
+			X:      position % columns * width,
+			Y:      position / columns * height,
+			Width:  width,
+			Height: height,
+		}
+		if k == 0 {
+			frame.Start = 0
+		}
+		if k < len(frames)-1 {
+			frame.End = times[k+1]
+		}
+		manifest[k] = frame
+		vttContents.WriteString(fmt.Sprintf("%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			helpers.FormatVTTTime(frame.Start), helpers.FormatVTTTime(frame.End),
+			frame.Sheet, frame.X, frame.Y, frame.Width, frame.Height))
+	}
+	err = os.WriteFile(filepath.Join(targetPath, fmt.Sprintf("timeline-%s.vtt", format.Name)), []byte(vttContents.String()), os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "can't write vtt file")
+	}
+	manifestContents, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(targetPath, fmt.Sprintf("timeline-%s.json", format.Name)), manifestContents, 0644)
+	if err != nil {
+		return errors.Wrap(err, "can't write timeline manifest")
+	}
+	for i, sheetFile := range sheetFiles {
+		sheetFrames := frames[i*perSheet : min(len(frames), (i+1)*perSheet)]
+		var args = []string{"-background", "black"}
+		for r := 0; r*columns < len(sheetFrames); r++ {
+			args = append(args, "(")
+			args = append(args, sheetFrames[r*columns:min(len(sheetFrames), (r+1)*columns)]...)
+			args = append(args, "+append", ")")
+		}
+		args = append(args, "-append")
+		switch format.TimelineType {
+		case "jpg":
+			args = append(args, "-quality", "85")
+		case "webp":
+			args = append(args, "-quality", "92")
+		}
+		args = append(args, filepath.Join(targetPath, sheetFile))
+		out, err := exec.Command("convert", args...).CombinedOutput()
+		if err != nil {
+			log.Println(string(out))
+			return errors.Wrap(err, "error creating timeline combined image")
+		}
+	}
+	syscall.Sync()
+	info.TimelineType = format.TimelineType
+	info.TimelineFrames = int32(len(frames))
+	info.TimelineSize = types.Size{Width: int64(width), Height: int64(height)}
+	info.TimelineSheets = int32(sheets)
+	info.TimelineColumns = int32(columns)
+	return nil
+}
+
+// timelineGrid returns amount of columns and rows per sheet fitting into maxSheetSize.
+// Without columns every sheet is a single row.
+func timelineGrid(frames int, width int, height int, columns int, maxSheetSize int) (int, int) {
+	if maxSheetSize <= 0 {
+		maxSheetSize = defaultTimelineMaxSheetSize
+	}
+	rows := max(1, maxSheetSize/max(1, height))
+	if columns <= 0 {
+		rows = 1
+		columns = frames
+	}
+	columns = max(1, min(columns, frames, maxSheetSize/max(1, width)))
+	return columns, rows
+}
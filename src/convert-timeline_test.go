@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestTimelineGrid(t *testing.T) {
+	for _, c := range []struct {
+		frames, width, height, columns, maxSheetSize int
+		expectedColumns, expectedRows                int
+	}{
+		{frames: 500, width: 160, height: 90, columns: 0, maxSheetSize: 0, expectedColumns: 102, expectedRows: 1},
+		{frames: 20, width: 160, height: 90, columns: 0, maxSheetSize: 0, expectedColumns: 20, expectedRows: 1},
+		{frames: 500, width: 160, height: 90, columns: 10, maxSheetSize: 0, expectedColumns: 10, expectedRows: 182},
+		{frames: 500, width: 160, height: 90, columns: 10, maxSheetSize: 900, expectedColumns: 5, expectedRows: 10},
+	} {
+		columns, rows := timelineGrid(c.frames, c.width, c.height, c.columns, c.maxSheetSize)
+		if columns != c.expectedColumns || rows != c.expectedRows {
+			t.Errorf("%+v: expected %dx%d grid, got %dx%d", c, c.expectedColumns, c.expectedRows, columns, rows)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/helpers"
+	"github.com/totaltube/conversion/types"
+)
+
+// maxReportedDecodeErrors limits amount of decoder messages included into the validation report
+const maxReportedDecodeErrors = 3
+
+// ValidateSource checks the source video for truncation, container inconsistencies and decode errors.
+// repairable is false when at least one of the issues can't be fixed by remuxing.
+func ValidateSource(sourceFile string) (issues []string, repairable bool, err error) {
+	repairable = true
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", sourceFile)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	probeErr := cmd.Run()
+	if strings.Contains(stderr.String(), "moov atom not found") {
+		issues = append(issues, "missing moov atom: the file is truncated or its recording was not finalized")
+		repairable = false
+		return
+	}
+	if probeErr != nil {
+		issues = append(issues, "can't read container: "+firstLine(stderr.String(), probeErr.Error()))
+		repairable = false
+		return
+	}
+	var fileFormat types.FileFormat
+	if err = json.Unmarshal(stdout.Bytes(), &fileFormat); err != nil {
+		err = errors.New("can't parse ffprobe output: " + err.Error())
+		return
+	}
+	videoStream, _ := probeStreams(fileFormat)
+	if videoStream == nil {
+		issues = append(issues, "no video stream found")
+		repairable = false
+		return
+	}
+	formatDuration, _ := strconv.ParseFloat(fileFormat.Format.Duration, 64)
+	streamDuration, _ := strconv.ParseFloat(videoStream.Duration, 64)
+	if formatDuration <= 0 {
+		issues = append(issues, "container has no duration")
+	} else if streamDuration > 0 && math.Abs(formatDuration-streamDuration) > math.Max(2, formatDuration*0.05) {
+		issues = append(issues, fmt.Sprintf("duration mismatch: container says %.2fs, video stream %.2fs",
+			formatDuration, streamDuration))
+	}
+	stderr.Reset()
+	cmd = exec.Command("ffmpeg", "-hide_banner", "-nostats", "-v", "error", "-i", sourceFile,
+		"-map", "0:v:0", "-map", "0:a?", "-f", "null", "-")
+	cmd.Stderr = &stderr
+	decodeErr := cmd.Run()
+	var decodeErrors []string
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			decodeErrors = append(decodeErrors, line)
+		}
+	}
+	if len(decodeErrors) > 0 {
+		issues = append(issues, fmt.Sprintf("%d decode errors: %s", len(decodeErrors),
+			strings.Join(decodeErrors[:min(len(decodeErrors), maxReportedDecodeErrors)], "; ")))
+	} else if decodeErr != nil {
+		issues = append(issues, "decoding failed: "+decodeErr.Error())
+	}
+	return
+}
+
+// RepairSource remuxes the source with regenerated timestamps, dropping corrupted packets
+func RepairSource(sourceFile string, tempPath string) (repairedFile string, err error) {
+	// the source extension is kept in the name, so a.mp4 and a.mov don't overwrite each other
+	repairedFile = filepath.Join(tempPath, "__repaired_"+filepath.Base(sourceFile)+".mkv")
+	cmd := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error",
+		"-fflags", "+genpts+discardcorrupt+igndts", "-err_detect", "ignore_err",
+		"-i", sourceFile,
+		"-map", "0:v:0", "-map", "0:a?",
+		"-c", "copy", "-avoid_negative_ts", "make_zero",
+		repairedFile)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Println(string(out))
+		err = errors.Wrap(err, "can't repair source "+filepath.Base(sourceFile))
+		return
+	}
+	if !helpers.FileExists(repairedFile) {
+		err = errors.New("repaired file for " + filepath.Base(sourceFile) + " not created")
+		return
+	}
+	var fileFormat types.FileFormat
+	if fileFormat, err = probeFile(repairedFile); err != nil {
+		err = errors.Wrap(err, "repaired file is not readable")
+		return
+	}
+	if duration, _ := strconv.ParseFloat(fileFormat.Format.Duration, 64); duration <= 0 {
+		err = errors.New("repaired file of " + filepath.Base(sourceFile) + " has no duration")
+		return
+	}
+	return
+}
+
+func firstLine(s string, fallback string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return fallback
+}
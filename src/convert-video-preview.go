@@ -1,11 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
@@ -16,149 +13,349 @@ import (
 	"github.com/totaltube/conversion/types"
 )
 
-// ExtractVideoSegments извлекает несколько сегментов из видео файла
-func ExtractVideoSegments(sourceFile string, tempPath string, segmentsCount int64, segmentDuration float64) ([]string, error) {
-	// Получаем информацию о видео
-	cmd := exec.Command("ffprobe", sourceFile, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, errors.Wrap(err, "can't run ffprobe for video info")
+// previewFPS частота кадров video preview
+const previewFPS = 25
+
+// previewAudioFade длительность нарастания и затухания звука превью
+const previewAudioFade = 0.5
+
+// previewFormatExtensions сопоставляет поддерживаемые ThumbFormatShort.VideoFormats расширениям файлов video-preview-<name>
+var previewFormatExtensions = map[string]string{
+	"mp4":  "mp4",
+	"webm": "webm",
+	"av1":  "av1.webm",
+	"avif": "avif",
+}
+
+// videoPreview файл превью одного из запрошенных форматов и рендишенов
+type videoPreview struct {
+	format  string
+	file    string
+	size    types.Size
+	bitrate int64
+	retina  bool
+}
+
+// info возвращает описание превью для ответа
+func (p videoPreview) info() types.VideoPreviewFile {
+	return types.VideoPreviewFile{
+		File:    filepath.Base(p.file),
+		Format:  p.format,
+		Size:    p.size,
+		Bitrate: p.bitrate,
+		Retina:  p.retina,
 	}
+}
 
+// previewSource исходное видео превью с выбранными сегментами
+type previewSource struct {
+	types.PreviewPlan
+	File       string
+	Transition string
+	// TransitionDuration уже ограничена половиной самого короткого сегмента
+	TransitionDuration float64
+	Audio              bool
+	// Width и Height исходного видео ограничивают retina рендишены
+	Width  int64
+	Height int64
+}
+
+// planVideoPreview выбирает сегменты для превью. Хэндлеры строят план один раз и передают его
+// в CreateVideoPreview и CreateAnimatedPreview, чтобы оба превью использовали одни и те же сегменты.
+func planVideoPreview(sourceFile string, tempPath string, format types.ThumbFormatShort) (source previewSource, err error) {
+	// Получаем информацию о видео
 	var fileFormat types.FileFormat
-	err = json.Unmarshal(out, &fileFormat)
+	fileFormat, err = probeFile(sourceFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't parse ffprobe output")
+		return
 	}
-
 	duration, err := strconv.ParseFloat(fileFormat.Format.Duration, 64)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't parse video duration")
+		err = errors.Wrap(err, "can't parse video duration")
+		return
 	}
-
-	if duration < segmentDuration*float64(segmentsCount) {
-		return nil, errors.New("video duration too short for requested segments")
+	// Выбираем точки для извлечения сегментов
+	source.File = sourceFile
+	source.PreviewPlan, err = planPreviewSegments(sourceFile, tempPath, duration, format.SegmentsCount, format.SegmentDuration, format)
+	if err != nil {
+		return
+	}
+	if strings.Trim(format.TransitionType, "abcdefghijklmnopqrstuvwxyz") != "" {
+		err = errors.New("wrong transition type " + format.TransitionType)
+		return
+	}
+	if format.TransitionType != "" && len(source.Segments) > 1 {
+		source.Transition = format.TransitionType
+		source.TransitionDuration = format.TransitionDuration
+		if source.TransitionDuration <= 0 {
+			source.TransitionDuration = 0.5
+		}
+		for _, segment := range source.Segments {
+			source.TransitionDuration = min(source.TransitionDuration, source.outDuration(segment)/2)
+		}
+	}
+	videoStream, audioStream := probeStreams(fileFormat)
+	if videoStream != nil {
+		source.Width, source.Height = int64(videoStream.Width), int64(videoStream.Height)
 	}
+	source.Audio = format.PreviewAudio && audioStream != nil
+	return
+}
 
-	// Создаем директорию для сегментов
-	segmentsDir := filepath.Join(tempPath, "video_segments")
-	err = os.MkdirAll(segmentsDir, os.ModePerm)
-	if err != nil {
-		return nil, errors.Wrap(err, "can't create segments directory")
+// inputArgs возвращает входы ffmpeg, читающие только сегменты исходника
+func (s previewSource) inputArgs() (args []string) {
+	for _, segment := range s.Segments {
+		args = append(args,
+			"-ss", strconv.FormatFloat(segment.Start, 'f', 3, 64),
+			"-t", strconv.FormatFloat(segment.Duration, 'f', 3, 64),
+			"-i", s.File)
 	}
+	return
+}
 
-	var segmentFiles []string
+// outDuration возвращает длительность сегмента в превью
+func (s previewSource) outDuration(segment types.PreviewSegment) float64 {
+	if s.Speed > 0 {
+		return segment.Duration / s.Speed
+	}
+	return segment.Duration
+}
 
-	// Выбираем точки для извлечения сегментов
-	// Распределяем равномерно по длительности видео
-	interval := duration / float64(segmentsCount+1)
+// speedFilter возвращает выражение setpts, проигрывающее сегмент со скоростью плана
+func (s previewSource) speedFilter() string {
+	if s.Speed > 0 && s.Speed != 1 {
+		return "setpts=(PTS-STARTPTS)/" + strconv.FormatFloat(s.Speed, 'f', 3, 64)
+	}
+	return "setpts=PTS-STARTPTS"
+}
 
-	for i := range segmentsCount {
-		// Добавляем небольшую рандомизацию чтобы сегменты не были слишком предсказуемыми
-		randomOffset := rand.Float64() * interval * 0.3 // ±15% от интервала
-		seekTime := interval*float64(i+1) + randomOffset
+// duration возвращает длительность склеенных сегментов
+func (s previewSource) duration() (duration float64) {
+	for _, segment := range s.Segments {
+		duration += s.outDuration(segment)
+	}
+	if s.Transition != "" {
+		duration -= s.TransitionDuration * float64(len(s.Segments)-1)
+	}
+	return
+}
 
-		if seekTime+segmentDuration > duration {
-			seekTime = duration - segmentDuration
+// videoGraph возвращает граф фильтров, склеивающий сегменты в поток [pv], с переходами xfade, если они заданы.
+// При перекодировании seek на входе точен до кадра, trim обрезает каждый сегмент до точной длительности.
+func (s previewSource) videoGraph() string {
+	var graph strings.Builder
+	for k, segment := range s.Segments {
+		graph.WriteString(fmt.Sprintf("[%d:v:0]trim=duration=%s,%s,fps=%d,setsar=1,format=yuv420p[v%d];",
+			k, strconv.FormatFloat(segment.Duration, 'f', 3, 64), s.speedFilter(), previewFPS, k))
+	}
+	if s.Transition == "" {
+		for k := range s.Segments {
+			graph.WriteString(fmt.Sprintf("[v%d]", k))
 		}
-		if seekTime < 0 {
-			seekTime = 0
+		graph.WriteString(fmt.Sprintf("concat=n=%d:v=1:a=0[pv]", len(s.Segments)))
+		return graph.String()
+	}
+	var offset float64
+	previous := "v0"
+	for k := 1; k < len(s.Segments); k++ {
+		offset += s.outDuration(s.Segments[k-1]) - s.TransitionDuration
+		current := fmt.Sprintf("x%d", k)
+		if k == len(s.Segments)-1 {
+			current = "pv"
 		}
-
-		segmentFile := filepath.Join(segmentsDir, fmt.Sprintf("segment_%d.mp4", i))
-		segmentFiles = append(segmentFiles, segmentFile)
-
-		// Извлекаем сегмент
-		seekSeconds := strconv.FormatFloat(seekTime, 'f', 2, 64)
-		durationStr := strconv.FormatFloat(segmentDuration, 'f', 2, 64)
-
-		cmd := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error",
-			"-ss", seekSeconds,
-			"-i", sourceFile,
-			"-t", durationStr,
-			"-c", "copy", // копируем без перекодирования для скорости
-			segmentFile)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("Error extracting segment %d: %s", i, string(out))
-			return nil, errors.Wrapf(err, "can't extract video segment %d", i)
+		graph.WriteString(fmt.Sprintf("[%s][v%d]xfade=transition=%s:duration=%s:offset=%s[%s]", previous, k, s.Transition,
+			strconv.FormatFloat(s.TransitionDuration, 'f', 3, 64), strconv.FormatFloat(offset, 'f', 3, 64), current))
+		if current != "pv" {
+			graph.WriteString(";")
 		}
+		previous = current
 	}
-
-	return segmentFiles, nil
+	return graph.String()
 }
 
-// ConcatVideoSegments склеивает несколько видео сегментов в один файл
-func ConcatVideoSegments(segmentFiles []string, outputFile string) error {
-	if len(segmentFiles) == 0 {
-		return errors.New("no segment files provided")
+// audioGraph возвращает граф фильтров, склеивающий звук сегментов в поток [pa],
+// с кроссфейдом при заданных переходах, нарастанием в начале и затуханием в конце
+func (s previewSource) audioGraph() string {
+	var graph strings.Builder
+	var tempo string
+	if s.Speed > 0 && s.Speed != 1 {
+		tempo = ",atempo=" + strconv.FormatFloat(s.Speed, 'f', 3, 64)
 	}
-
-	if len(segmentFiles) == 1 {
-		// Если только один сегмент, просто копируем
-		return exec.Command("cp", segmentFiles[0], outputFile).Run()
+	for k, segment := range s.Segments {
+		graph.WriteString(fmt.Sprintf("[%d:a:0]atrim=duration=%s,asetpts=PTS-STARTPTS%s,aresample=48000,"+
+			"aformat=sample_fmts=fltp:channel_layouts=stereo[a%d];",
+			k, strconv.FormatFloat(segment.Duration, 'f', 3, 64), tempo, k))
 	}
-
-	// Создаем файл со списком для concat
-	concatFile := outputFile + ".concat.txt"
-	var concatContent strings.Builder
-
-	for _, segment := range segmentFiles {
-		concatContent.WriteString(fmt.Sprintf("file '%s'\n", segment))
+	if s.Transition == "" {
+		for k := range s.Segments {
+			graph.WriteString(fmt.Sprintf("[a%d]", k))
+		}
+		graph.WriteString(fmt.Sprintf("concat=n=%d:v=0:a=1[ac];", len(s.Segments)))
+	} else {
+		previous := "a0"
+		for k := 1; k < len(s.Segments); k++ {
+			graph.WriteString(fmt.Sprintf("[%s][a%d]acrossfade=d=%s[c%d];", previous, k,
+				strconv.FormatFloat(s.TransitionDuration, 'f', 3, 64), k))
+			previous = fmt.Sprintf("c%d", k)
+		}
+		graph.WriteString(fmt.Sprintf("[%s]anull[ac];", previous))
 	}
+	fade := min(previewAudioFade, s.duration()/4)
+	graph.WriteString(fmt.Sprintf("[ac]afade=t=in:d=%s,afade=t=out:st=%s:d=%s[pa]",
+		strconv.FormatFloat(fade, 'f', 3, 64), strconv.FormatFloat(s.duration()-fade, 'f', 3, 64),
+		strconv.FormatFloat(fade, 'f', 3, 64)))
+	return graph.String()
+}
 
-	err := os.WriteFile(concatFile, []byte(concatContent.String()), 0644)
-	if err != nil {
-		return errors.Wrap(err, "can't write concat file")
+// CreateVideoPreview создает video preview из исходного видео файла в каждом из форматов VideoFormats
+// (mp4 по умолчанию) и каждом из PreviewRenditions за один проход ffmpeg: сегменты декодируются один раз
+// и раздаются во все выходы.
+// Если общий проход не удался, форматы кодируются по отдельности, неудавшиеся возвращаются в failed
+// именами файлов. Если не удалось ни одного, возвращается ошибка.
+func CreateVideoPreview(source previewSource, format types.ThumbFormatShort, targetPath string) (previews []videoPreview, failed []string, err error) {
+	var videoFormats = format.VideoFormats
+	if len(videoFormats) == 0 {
+		videoFormats = []string{"mp4"}
 	}
-	defer os.Remove(concatFile)
-
-	// Склеиваем сегменты
-	cmd := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error",
-		"-f", "concat",
-		"-safe", "0",
-		"-i", concatFile,
-		"-c", "copy",
-		outputFile)
-
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Error concatenating segments: %s", string(out))
-		return errors.Wrap(err, "can't concatenate video segments")
+	for _, videoFormat := range videoFormats {
+		if _, ok := previewFormatExtensions[videoFormat]; !ok {
+			err = errors.New("unsupported video preview format " + videoFormat)
+			return
+		}
 	}
-
-	return nil
+	outputs := previewOutputs(source, videoFormats, format, targetPath)
+	err = encodeVideoPreviews(source, outputs, format)
+	if err == nil {
+		previews = outputs
+		return
+	}
+	if len(outputs) == 1 {
+		return
+	}
+	var lastErr error
+	for _, output := range outputs {
+		lastErr = encodeVideoPreviews(source, []videoPreview{output}, format)
+		if lastErr != nil {
+			log.Printf("Error creating video preview %s: %v", filepath.Base(output.file), lastErr)
+			failed = append(failed, filepath.Base(output.file))
+			continue
+		}
+		previews = append(previews, output)
+	}
+	if len(previews) == 0 {
+		failed = nil
+		err = lastErr
+		return
+	}
+	err = nil
+	return
 }
 
-// CreateVideoPreview создает video preview из исходного видео файла
-func CreateVideoPreview(sourceFile string, tempPath string, format types.ThumbFormatShort, outputFile string) error {
-	// Извлекаем сегменты
-	segmentFiles, err := ExtractVideoSegments(sourceFile, tempPath, format.SegmentsCount, format.SegmentDuration)
-	if err != nil {
-		return errors.Wrap(err, "can't extract video segments")
+// previewOutputs возвращает файлы превью для кодирования. Без PreviewRenditions это один
+// video-preview-<name>.<ext> размера VideoSize на формат, иначе video-preview-<name>-<W>x<H>[@2x].<ext>
+// для каждого рендишена. Варианты @2x пропускаются, если исходник меньше удвоенного размера.
+func previewOutputs(source previewSource, videoFormats []string, format types.ThumbFormatShort, targetPath string) (outputs []videoPreview) {
+	for _, videoFormat := range videoFormats {
+		ext := previewFormatExtensions[videoFormat]
+		if len(format.PreviewRenditions) == 0 {
+			outputs = append(outputs, videoPreview{
+				format:  videoFormat,
+				file:    filepath.Join(targetPath, fmt.Sprintf("video-preview-%s.%s", format.Name, ext)),
+				size:    format.VideoSize,
+				bitrate: format.VideoBitrate,
+			})
+			continue
+		}
+		for _, rendition := range format.PreviewRenditions {
+			bitrate := rendition.VideoBitrate
+			if bitrate <= 0 {
+				bitrate = format.VideoBitrate
+			}
+			name := fmt.Sprintf("video-preview-%s-%dx%d", format.Name, rendition.Size.Width, rendition.Size.Height)
+			outputs = append(outputs, videoPreview{
+				format:  videoFormat,
+				file:    filepath.Join(targetPath, name+"."+ext),
+				size:    rendition.Size,
+				bitrate: bitrate,
+			})
+			if !rendition.Retina {
+				continue
+			}
+			if source.Width < rendition.Size.Width*2 || source.Height < rendition.Size.Height*2 {
+				log.Printf("source %dx%d is too small for retina preview %s", source.Width, source.Height, name)
+				continue
+			}
+			outputs = append(outputs, videoPreview{
+				format:  videoFormat,
+				file:    filepath.Join(targetPath, name+"@2x."+ext),
+				size:    types.Size{Width: rendition.Size.Width * 2, Height: rendition.Size.Height * 2},
+				bitrate: bitrate * 2,
+				retina:  true,
+			})
+		}
 	}
+	return
+}
 
-	// Склеиваем сегменты в preview
-	concatFile := filepath.Join(tempPath, "preview_concat.mp4")
-	err = ConcatVideoSegments(segmentFiles, concatFile)
-	if err != nil {
-		return errors.Wrap(err, "can't concatenate segments")
-	}
-
-	// Применяем финальное кодирование с нужными параметрами размера и битрейта
-	sizeStr := fmt.Sprintf("%dx%d", format.VideoSize.Width, format.VideoSize.Height)
-	bitrateStr := fmt.Sprintf("%dk", format.VideoBitrate)
-
-	cmd := exec.Command("ffmpeg", "-y", "-hide_banner", "-loglevel", "error",
-		"-i", concatFile,
-		"-vf", fmt.Sprintf("scale=%s", sizeStr),
-		"-b:v", bitrateStr,
-		"-r", "25",
-		"-c:v", "libx264",
-		"-preset", "fast",
-		"-an",
-		outputFile)
+// encodeVideoPreviews применяет финальное кодирование с размером и битрейтом каждого из выходов
+func encodeVideoPreviews(source previewSource, outputs []videoPreview, format types.ThumbFormatShort) error {
+	graph := source.videoGraph() + fmt.Sprintf(";[pv]split=%d", len(outputs))
+	for k := range outputs {
+		graph += fmt.Sprintf("[s%d]", k)
+	}
+	for k, output := range outputs {
+		graph += fmt.Sprintf(";[s%d]scale=%d:%d[o%d]", k, output.size.Width, output.size.Height, k)
+	}
+	var audioOutputs int
+	for _, output := range outputs {
+		if source.Audio && output.format != "avif" {
+			audioOutputs++
+		}
+	}
+	if audioOutputs > 0 {
+		graph += ";" + source.audioGraph() + fmt.Sprintf(";[pa]asplit=%d", audioOutputs)
+		for k := 0; k < audioOutputs; k++ {
+			graph += fmt.Sprintf("[ao%d]", k)
+		}
+	}
+	audioBitrate := format.AudioBitrate
+	if audioBitrate <= 0 {
+		audioBitrate = 64
+	}
+	args := []string{"-y", "-hide_banner", "-loglevel", "error"}
+	args = append(args, source.inputArgs()...)
+	args = append(args, "-filter_complex", graph)
+	var audioOutput int
+	for k, output := range outputs {
+		args = append(args, "-map", fmt.Sprintf("[o%d]", k), "-b:v", fmt.Sprintf("%dk", output.bitrate))
+		switch output.format {
+		case "webm":
+			args = append(args, "-c:v", "libvpx-vp9", "-deadline", "good", "-cpu-used", "4", "-row-mt", "1")
+		case "av1":
+			args = append(args, "-c:v", "libaom-av1", "-cpu-used", "6", "-row-mt", "1")
+		case "avif":
+			args = append(args, "-c:v", "libaom-av1", "-cpu-used", "6", "-row-mt", "1", "-pix_fmt", "yuv420p", "-f", "avif")
+		default:
+			args = append(args, "-c:v", "libx264", "-preset", "fast")
+		}
+		if source.Audio && output.format != "avif" {
+			args = append(args, "-map", fmt.Sprintf("[ao%d]", audioOutput), "-b:a", fmt.Sprintf("%dk", audioBitrate))
+			if output.format == "mp4" {
+				args = append(args, "-c:a", "aac")
+			} else {
+				args = append(args, "-c:a", "libopus")
+			}
+			audioOutput++
+		} else {
+			args = append(args, "-an")
+		}
+		args = append(args, metadataArgs(format.Metadata)...)
+		if output.format == "mp4" {
+			args = append(args, movflagsArgs("mp4", format.Metadata)...)
+		}
+		args = append(args, output.file)
+	}
+	cmd := exec.Command("ffmpeg", args...)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
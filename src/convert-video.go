@@ -2,20 +2,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	_ "image/png"
 	"io/ioutil"
 	"log"
 	"math"
-	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/xid"
@@ -154,51 +154,51 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 			}
 		}()
 	}
-	if len(sourceFiles) > 1 {
-		// Need to concatenate videos first
-		fileExtension := ""
-		concatFile := ""
-		for _, f := range sourceFiles {
-			ext := strings.ToLower(filepath.Ext(f))
-			if fileExtension == "" {
-				fileExtension = ext
-			} else if fileExtension != ext {
-				err = errors.New("can't concatenate files with different extensions ( " + fileExtension + " and " + ext + " )")
+	var sourceIssues []string
+	var sourceRepaired bool
+	if format.ValidateSource {
+		sourceFiles = slices.Clone(sourceFiles)
+		for k, f := range sourceFiles {
+			var issues []string
+			var repairable bool
+			issues, repairable, err = ValidateSource(f)
+			if err != nil {
 				return
 			}
-			absPath, _ := filepath.Abs(f)
-			concatFile += "file " + absPath + "\n"
-		}
-		concatFilePath := filepath.Join(tempPath, "concat.txt")
-		err = os.WriteFile(concatFilePath, []byte(concatFile), 0644)
-		if err != nil {
-			err = errors.New("can't write " + concatFilePath + " file: " + err.Error())
-			return
+			if len(issues) == 0 {
+				continue
+			}
+			if len(sourceFiles) > 1 {
+				for i := range issues {
+					issues[i] = filepath.Base(f) + ": " + issues[i]
+				}
+			}
+			sourceIssues = append(sourceIssues, issues...)
+			if !format.RepairSource || !repairable {
+				err = errors.New("source file is damaged: " + strings.Join(issues, "; "))
+				return
+			}
+			sourceFiles[k], err = RepairSource(f, tempPath)
+			if err != nil {
+				err = errors.Wrap(err, "source file is damaged ("+strings.Join(issues, "; ")+")")
+				return
+			}
+			sourceRepaired = true
 		}
-		sourceFile = filepath.Join(tempPath, "__file."+fileExtension)
-		command := exec.Command("ffmpeg", "-y", "-f", "concat", "-i", concatFilePath, "-c", "copy", sourceFile)
-		var out []byte
-		out, err = command.CombinedOutput()
+	}
+	if len(sourceFiles) > 1 {
+		// Need to concatenate videos first
+		sourceFile, err = concatSources(sourceFiles, tempPath)
 		if err != nil {
-			log.Println(string(out))
-			err = errors.New("can't concatenate video files " + helpers.ToJSON(sourceFiles) + ": " + err.Error())
 			return
 		}
 	} else {
 		sourceFile = sourceFiles[0]
 	}
 	sourceFile, _ = filepath.Abs(sourceFile)
-	probeCmd := exec.Command("ffprobe", sourceFile, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams")
-	var out []byte
-	out, err = probeCmd.CombinedOutput()
+	var fileFormat types.FileFormat
+	fileFormat, err = probeFile(sourceFile)
 	if err != nil {
-		err = errors.New("can't run ffprobe: " + err.Error())
-		return
-	}
-	var fileFormat FileFormat
-	err = json.Unmarshal(out, &fileFormat)
-	if err != nil {
-		err = errors.New("can't parse ffprobe output: " + err.Error())
 		return
 	}
 	copyAudioStream := false
@@ -208,6 +208,7 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 	var sourceVideoBitrate uint64
 	var sourceWidth int64
 	var sourceHeight int64
+	var sourceFrameRate float64
 	for _, stream := range fileFormat.Streams {
 		if stream.CodecType == "audio" {
 			sourceAudioBitrate, _ := strconv.ParseUint(stream.BitRate, 10, 64)
@@ -215,7 +216,7 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 			if sourceAudioBitrate != 0 && (sourceAudioBitrate < uint64(float32(format.AudioBitrate)*1.3) ||
 				format.AudioBitrate == 0) {
 				format.AudioBitrate = int32(sourceAudioBitrate)
-				if format.Type == "mp4" && stream.CodecName == "aac" {
+				if (format.Type == "mp4" || format.Type == "hls") && stream.CodecName == "aac" {
 					copyAudioStream = true
 				}
 				if format.Type == "webm" && (stream.CodecName == "vorbis" || stream.CodecName == "opus") {
@@ -227,24 +228,16 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 			}
 		}
 		if stream.CodecType == "video" {
-			sizeOk := true
 			sourceWidth = int64(stream.Width)
 			sourceHeight = int64(stream.Height)
-			if format.Crop && (format.Size.Width != int64(stream.Width) || format.Size.Height != int64(stream.Height)) {
-				sizeOk = false
-			}
-			if !format.Crop && math.Abs(float64(format.Size.Width-int64(stream.Width)))/float64(format.Size.Width) > 0.2 {
-				sizeOk = false
-			}
-			if !format.Crop && math.Abs(float64(format.Size.Height-int64(stream.Height)))/float64(format.Size.Height) > 0.2 {
-				sizeOk = false
-			}
+			sourceFrameRate = parseFrameRate(stream.RFrameRate)
+			sizeOk := videoSizeOk(format, stream.Width, stream.Height)
 			sourceVideoBitrate, _ = strconv.ParseUint(stream.BitRate, 10, 64)
 			sourceVideoBitrate = sourceVideoBitrate / 1000
 			if sourceVideoBitrate != 0 && (sourceVideoBitrate < uint64(float32(format.VideoBitrate)*1.2) ||
 				format.VideoBitrate == 0) {
 				format.VideoBitrate = int32(sourceVideoBitrate)
-				if format.Type == "mp4" && (stream.CodecName == "h264") {
+				if (format.Type == "mp4" || format.Type == "hls") && (stream.CodecName == "h264") {
 					copyVideoStream = true
 				}
 				if format.Type == "webm" && (stream.CodecName == "vp8" || stream.CodecName == "vp9" || stream.CodecName == "h264") {
@@ -255,32 +248,74 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 				}
 			}
 			if !sizeOk {
-				if format.Crop {
-					resizeOptions = fmt.Sprintf(`-vf scale=(iw*sar)*max(%d/(iw*sar)\,%d/ih):ih*max(%d/(iw*sar)\,%d/ih),crop=%d:%d`,
-						format.Size.Width, format.Size.Height, format.Size.Width, format.Size.Height, format.Size.Width, format.Size.Height)
-				} else {
-					if float64(format.Size.Width)/float64(format.Size.Height) > float64(stream.Width)/float64(stream.Height) {
-						resizeOptions = fmt.Sprintf(`-vf scale=-2:%d`, format.Size.Height)
-					} else {
-						resizeOptions = fmt.Sprintf(`-vf scale=%d:-2`, format.Size.Width)
-					}
-				}
+				resizeOptions = "-vf " + scaleFilter(format, stream.Width, stream.Height)
 				copyVideoStream = false
 			}
 		}
 	}
+	if format.KeyframeInterval > 0 || format.ClosedGOP || format.DisableSceneCut {
+		// GOP structure can be changed only by encoding
+		copyVideoStream = false
+	}
+	var resultFile = filepath.Join(targetPath, fmt.Sprintf("video-%s.%s", format.Name, videoExtension(format.Type)))
 	if float64(sourceVideoBitrate) < float64(formatVideoBitrate)*1.2 && (float64(sourceWidth) < float64(format.Size.Width)*0.8 || float64(sourceHeight) < float64(format.Size.Height)*0.8) {
 		err = errors.New("source file is too low quality to create this format")
 		return
 	}
 
+	// ffmpeg encrypts hls segments with the key written beforehand
+	var key *hlsKey
+	var keyFile string
+	var hlsOptions string
+	if format.Type == "hls" && format.HLSEncrypt {
+		if key, err = newHLSKey(format); err != nil {
+			return
+		}
+		keyFile, _ = filepath.Abs(filepath.Join(targetPath, fmt.Sprintf("key-%s.key", format.Name)))
+		keyInfoFile, _ := filepath.Abs(filepath.Join(tempPath, fmt.Sprintf("key-%s.keyinfo", format.Name)))
+		if err = key.write(keyFile, keyInfoFile); err != nil {
+			return
+		}
+		hlsOptions = "-hls_key_info_file " + keyInfoFile + " "
+	}
 	cmd := format.Command
 	if cmd == "" {
 		cmd = "ffmpeg -y -i %SOURCE_FILE% -an -pass 1 %VIDEO_OPTIONS% %RESIZE_OPTIONS% -preset fast -threads 2 -f mp4 /dev/null && ffmpeg -y -i %SOURCE_FILE% %AUDIO_OPTIONS% -pass 2 %VIDEO_OPTIONS% %RESIZE_OPTIONS% -preset fast -threads 2 "
-		if format.Type == "mp4" {
-			cmd += "-movflags faststart "
+		cmd += "%METADATA_OPTIONS% "
+		if flags := movflagsArgs(format.Type, format.Metadata); flags != nil {
+			cmd += strings.Join(flags, " ") + " "
+		}
+		if format.Type == "hls" {
+			segmentDuration := format.HLSSegmentDuration
+			if segmentDuration <= 0 {
+				segmentDuration = 6
+			}
+			segmentsPattern, _ := filepath.Abs(filepath.Join(targetPath, fmt.Sprintf("video-%s.%%d.ts", format.Name)))
+			cmd += fmt.Sprintf("-f hls -hls_time %s -hls_playlist_type vod -hls_segment_filename %s ",
+				strconv.FormatFloat(segmentDuration, 'f', 3, 64), segmentsPattern)
+			cmd += hlsOptions
 		}
 		cmd += "%RESULT_FILE%"
+	} else {
+		// Custom commands get metadata options and the hls key info right before the output file, like the default one
+		var options string
+		if !strings.Contains(cmd, "%METADATA_OPTIONS%") {
+			options = "%METADATA_OPTIONS% "
+			if flags := movflagsArgs(format.Type, format.Metadata); flags != nil && !strings.Contains(cmd, "-movflags") {
+				options += strings.Join(flags, " ") + " "
+			}
+		}
+		if !strings.Contains(cmd, "-hls_key_info_file") {
+			options += hlsOptions
+		}
+		if options != "" {
+			k := strings.LastIndex(cmd, "%RESULT_FILE%")
+			if k < 0 {
+				err = errors.New("format command has no %RESULT_FILE% placeholder")
+				return
+			}
+			cmd = cmd[:k] + options + cmd[k:]
+		}
 	}
 	if copyAudioStream {
 		cmd = strings.ReplaceAll(cmd, "%AUDIO_OPTIONS%", "-c:a copy")
@@ -290,9 +325,8 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 	if copyVideoStream {
 		cmd = strings.ReplaceAll(cmd, "%VIDEO_OPTIONS%", "-c:v copy")
 	} else {
-		cmd = strings.ReplaceAll(cmd, "%VIDEO_OPTIONS%", fmt.Sprintf("-b:v %dk", format.VideoBitrate))
+		cmd = strings.ReplaceAll(cmd, "%VIDEO_OPTIONS%", fmt.Sprintf("-b:v %dk", format.VideoBitrate)+gopOptions(format, sourceFrameRate))
 	}
-	var resultFile = filepath.Join(targetPath, fmt.Sprintf("video-%s.%s", format.Name, format.Type))
 	resultFileAbs, _ := filepath.Abs(resultFile)
 	syscall.Sync()
 	cmd = strings.ReplaceAll(cmd, "%SOURCE_FILE%", sourceFile)
@@ -304,6 +338,7 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 	cmd = strings.ReplaceAll(cmd, "%VIDEO_BITRATE%", strconv.FormatUint(uint64(format.VideoBitrate), 10))
 	cmd = strings.ReplaceAll(cmd, "%AUDIO_BITRATE%", strconv.FormatUint(uint64(format.AudioBitrate), 10))
 	cmd = strings.ReplaceAll(cmd, "%RESIZE_OPTIONS%", resizeOptions)
+	cmd = strings.ReplaceAll(cmd, "%METADATA_OPTIONS%", shellJoin(metadataArgs(format.Metadata)))
 	cmd = strings.ReplaceAll(cmd, "%TEMP_PATH%", "")
 	cmd = strings.ReplaceAll(cmd, "%FFMPEG%", "ffmpeg")
 	// Создаем команду для выполнения через bash
@@ -327,13 +362,123 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 	if !helpers.FileExists(resultFile) {
 		err = errors.New("result file " + resultFile + " not created during conversion. Something is wrong.")
 	}
-	probeCmd = exec.Command("ffprobe", resultFile, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams")
-	out, err = probeCmd.CombinedOutput()
+	info, err = readVideoInfo(resultFile, format)
 	if err != nil {
-		err = errors.New("can't run ffprobe: " + err.Error())
 		return
 	}
-	err = json.Unmarshal(out, &fileFormat)
+	info.SourceIssues = sourceIssues
+	info.SourceRepaired = sourceRepaired
+	if format.QualityCheck {
+		var quality types.VideoQuality
+		quality, err = CheckVideoQuality(sourceFile, resultFile, info.Duration, format)
+		if err != nil {
+			return
+		}
+		info.Quality = &quality
+		if err = checkQualityThreshold(quality, format); err != nil {
+			return
+		}
+	}
+	if format.CreatePoster {
+		err = createPoster(resultFile, tempPath, targetPath, info.Duration, format, &info)
+		if err != nil {
+			return
+		}
+	}
+	if format.CreateChapters {
+		var chapters []types.VideoChapter
+		chapters, err = CreateChapters(resultFile, tempPath, targetPath, info.Duration, format)
+		if err != nil {
+			err = errors.Wrap(err, "chapters create error")
+			log.Println(err)
+			return
+		}
+		info.Chapters = int32(len(chapters))
+	}
+	if format.CreateTimeline {
+		err = CreateVideoTimeline(resultFile, tempPath, targetPath, info.Duration, format, &info)
+		if err != nil {
+			err = errors.Wrap(err, "timeline create error")
+			log.Println(err)
+			return
+		}
+	}
+	if format.Type == "hls" {
+		info.HLSIFrames, err = CreateHLSPlaylists(resultFile, targetPath, info, format, key != nil)
+		if err != nil {
+			err = errors.Wrap(err, "hls playlists create error")
+			log.Println(err)
+			return
+		}
+		if key != nil {
+			// Goes last, the playlist can't be read locally after that
+			if err = key.publish(resultFile, keyFile); err != nil {
+				return
+			}
+			info.HLSKey = hex.EncodeToString(key.key)
+		}
+	}
+	return
+}
+
+// scaleFilter returns ffmpeg video filter fitting the source of given dimensions into the format size
+func scaleFilter(format types.VideoFormatShort, width int, height int) string {
+	if format.Crop {
+		return fmt.Sprintf(`scale=(iw*sar)*max(%d/(iw*sar)\,%d/ih):ih*max(%d/(iw*sar)\,%d/ih),crop=%d:%d`,
+			format.Size.Width, format.Size.Height, format.Size.Width, format.Size.Height, format.Size.Width, format.Size.Height)
+	}
+	if float64(format.Size.Width)/float64(format.Size.Height) > float64(width)/float64(height) {
+		return fmt.Sprintf(`scale=-2:%d`, format.Size.Height)
+	}
+	return fmt.Sprintf(`scale=%d:-2`, format.Size.Width)
+}
+
+// videoSizeOk checks if the source dimensions are close enough to the format size to keep the video stream as is
+func videoSizeOk(format types.VideoFormatShort, width int, height int) bool {
+	if format.Crop {
+		return format.Size.Width == int64(width) && format.Size.Height == int64(height)
+	}
+	if math.Abs(float64(format.Size.Width-int64(width)))/float64(format.Size.Width) > 0.2 {
+		return false
+	}
+	if math.Abs(float64(format.Size.Height-int64(height)))/float64(format.Size.Height) > 0.2 {
+		return false
+	}
+	return true
+}
+
+// videoExtension returns extension of the main result file for the format type
+func videoExtension(formatType string) string {
+	if formatType == "hls" {
+		return "m3u8"
+	}
+	return formatType
+}
+
+// gopOptions returns encoder options for keyframe placement requested in the format
+func gopOptions(format types.VideoFormatShort, frameRate float64) string {
+	var options string
+	if format.KeyframeInterval > 0 {
+		if frameRate <= 0 {
+			frameRate = 25
+		}
+		gop := int(math.Round(format.KeyframeInterval * frameRate))
+		options += fmt.Sprintf(" -g %d -keyint_min %d -force_key_frames 'expr:gte(t,n_forced*%s)'",
+			gop, gop, strconv.FormatFloat(format.KeyframeInterval, 'f', 3, 64))
+	}
+	if format.DisableSceneCut {
+		options += " -sc_threshold 0"
+	}
+	if format.ClosedGOP {
+		options += " -flags +cgop"
+	}
+	return options
+}
+
+// readVideoInfo probes converted video and checks that it is sane
+func readVideoInfo(resultFile string, format types.VideoFormatShort) (info types.ContentVideoInfo, err error) {
+	var fileFormat types.FileFormat
+	fileFormat, err = probeFile(resultFile)
 	if err != nil {
 		return
 	}
@@ -345,6 +490,10 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 			info.VideoBitrate = int32(bitrate)
 			info.Type = format.Type
 			info.Duration, _ = strconv.ParseFloat(v.Duration, 32)
+			if info.Duration <= 0 {
+				// Some containers (webm, hls) have no duration on stream level
+				info.Duration, _ = strconv.ParseFloat(fileFormat.Format.Duration, 32)
+			}
 		}
 		if v.CodecType == "audio" {
 			bitrate, _ := strconv.ParseInt(v.BitRate, 10, 32)
@@ -355,121 +504,5 @@ func ConvertVideo(sourceFiles []string, tempPath string, targetPath string, form
 		err = errors.New("wrong target video format")
 		return
 	}
-	if format.CreatePoster {
-		var seekPercent = rand.Float64()*(format.PosterTimeRange[1]-format.PosterTimeRange[0]) + format.PosterTimeRange[0]
-		posterFile := filepath.Join(targetPath, fmt.Sprintf("poster-%s.%s", format.Name, format.PosterType))
-		tempFile := filepath.Join(tempPath, "poster.png")
-		err = ExtractFrame(resultFile, time.Duration(float64(time.Second)*info.Duration*seekPercent/100), tempFile)
-		if err != nil {
-			log.Println(err)
-			err = errors.Wrap(err, "can't extract poster from result video")
-			return
-		}
-		if format.PosterType == "png" {
-			err = os.Rename(tempFile, posterFile)
-			if err != nil {
-				log.Println(err)
-				err = errors.Wrap(err, "poster create error")
-				return
-			}
-		} else {
-			if format.PosterCommand == "" {
-				if format.PosterType == "webp" {
-					format.PosterCommand = "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% -quality 92 %RESULT_FILE%"
-				} else {
-					format.PosterCommand = "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% -quality 84 %RESULT_FILE%"
-				}
-			}
-			err = ConvertImage(tempFile, format.PosterCommand, posterFile, "")
-			if err != nil {
-				log.Println(err)
-				err = errors.Wrap(err, "poster create error")
-				return
-			}
-		}
-		info.PosterType = format.PosterType
-	}
-	if format.CreateTimeline {
-		_ = os.MkdirAll(filepath.Join(tempPath, "timeline"), os.ModePerm)
-		err = doExtractFrames2(resultFile, filepath.Join(tempPath, "timeline"),
-			int64(format.TimelineMaxAmount), float64(format.TimelineMinInterval), false)
-		if err != nil {
-			err = errors.Wrap(err, "timeline create error")
-			log.Println(err)
-			return
-		}
-		matches, _ := filepath.Glob(filepath.Join(tempPath, "timeline", "*.png"))
-		if len(matches) > 0 {
-			info.TimelineFrames = int32(len(matches))
-			var gap = info.Duration / float64(len(matches))
-			var cmd = "convert %SOURCE_FILE% -resize %SIZE% %RESULT_FILE%"
-			if format.TimelineCrop {
-				cmd = "convert %SOURCE_FILE% -thumbnail %SIZE%^ -gravity center -extent %SIZE% %RESULT_FILE%"
-			}
-			var currentWidth int
-			var currentDuration float64
-			var vttContents = `WEBVTT
-			
-`
-			timelineFile := fmt.Sprintf("timeline-%s.%s", format.Name, format.TimelineType)
-			var timelineImages = make([]string, 0, len(matches))
-			for k, m := range matches {
-				frameFile := fmt.Sprintf("%d.png", k)
-				err = ConvertImage(m, cmd, filepath.Join(tempPath, "timeline", frameFile), fmt.Sprintf("%dx%d", format.TimelineSize.Width, format.TimelineSize.Height))
-				_ = os.Remove(m)
-				if err != nil {
-					err = errors.Wrap(err, "timeline frame conversion error")
-					log.Println(err)
-					return
-				}
-				var width int
-				var height int
-				width, height, err = helpers.GetImageDimensions(filepath.Join(tempPath, "timeline", frameFile))
-				if err != nil {
-					err = errors.Wrap(err, "error getting dimensions of timeline frame")
-					log.Println(err)
-					return
-				}
-				info.TimelineSize.Width = int64(width)
-				info.TimelineSize.Height = int64(height)
-				z := time.Unix(0, 0).UTC()
-				nextDuration := math.Min(info.Duration, gap+currentDuration)
-				vttContents += fmt.Sprintf(`%s.000 --> %s.000
-%s#xywh=%d,0,%d,%d
-
-`,
-					z.Add(time.Duration(currentDuration*float64(time.Second))).Format("15:04:05"),
-					z.Add(time.Duration(nextDuration*float64(time.Second))).Format("15:04:05"),
-					timelineFile, currentWidth, width, height)
-				currentWidth += width
-				currentDuration += gap
-				timelineImages = append(timelineImages, filepath.Join(tempPath, "timeline", frameFile))
-			}
-			err = os.WriteFile(filepath.Join(targetPath, fmt.Sprintf("timeline-%s.vtt", format.Name)), []byte(vttContents), os.ModePerm)
-			if err != nil {
-				log.Println(err)
-				err = errors.Wrap(err, "can't write vtt file")
-				return
-			}
-			var args = []string{"+append"}
-			args = append(args, timelineImages...)
-			switch format.TimelineType {
-			case "jpg":
-				args = append(args, "-quality", "85")
-			case "webp":
-				args = append(args, "-quality", "92")
-			}
-			args = append(args, filepath.Join(targetPath, timelineFile))
-			command := exec.Command("convert", args...)
-			out, err = command.CombinedOutput()
-			if err != nil {
-				err = errors.Wrap(err, "error creating timeline combined image")
-				log.Println(err, string(out))
-				return
-			}
-			syscall.Sync()
-			info.TimelineType = format.TimelineType
-		}
-	}
 	return
 }
@@ -85,7 +85,9 @@ func doExtractFrames(files []string, workingPath string, format *ExtractFramesFo
 	return
 }
 
-func doExtractFrames2(file string, destinationPath string, maxAmount int64, interval float64, randomize bool) (err error) {
+// doExtractFrames2 extracts frame.<i>.png files into destinationPath and returns their timestamps in seconds.
+// With keyframesOnly the nearest keyframes are taken, their times are approximate.
+func doExtractFrames2(file string, destinationPath string, maxAmount int64, interval float64, randomize bool, keyframesOnly bool) (times []float64, err error) {
 	// Getting video duration
 	cmd := exec.Command("ffprobe", file, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", "-print_format", "json")
 	var out []byte
@@ -133,15 +135,15 @@ func doExtractFrames2(file string, destinationPath string, maxAmount int64, inte
 		interval = (duration - startOffset) / float64(maxAmount+1)
 		start = interval
 	}
+	var frameFiles []string
 	var i int64
 	for i = 0; i < maxAmount; i++ {
-		seek := time.Duration(start+startOffset+float64(i)*interval) * time.Second
-		resultFileName := "frame." + strconv.FormatInt(i, 10) + ".png"
-		frameFile := filepath.Join(destinationPath, resultFileName)
-		err = ExtractFrame(file, seek, frameFile)
-		if err != nil {
-			return
-		}
+		times = append(times, start+startOffset+float64(i)*interval)
+		frameFiles = append(frameFiles, filepath.Join(destinationPath, "frame."+strconv.FormatInt(i, 10)+".png"))
+	}
+	err = ExtractFrames(file, times, frameFiles, keyframesOnly)
+	if err != nil {
+		times = nil
 	}
 	return
 }
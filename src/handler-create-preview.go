@@ -1,11 +1,11 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -82,24 +82,62 @@ func createPreviewHandler(c *gin.Context) {
 	// Use the selected file directly since we've already filtered it
 	videoSourceFile := localPath
 
-	// Create video preview
-	previewFileName := fmt.Sprintf("video-preview-%s.mp4", params.Format.Name)
-	previewFilePath := filepath.Join(tmpDir, previewFileName)
-	err = CreateVideoPreview(videoSourceFile, tmpDir, params.Format, previewFilePath)
+	// Plan segments once, video and animated previews use the same ones
+	var source previewSource
+	source, err = planVideoPreview(videoSourceFile, tmpDir, params.Format)
 	if err != nil {
-		log.Printf("Failed to create video preview: %v", err)
-		c.JSON(200, M{"success": false, "value": "failed to create video preview: " + err.Error()})
+		log.Printf("Failed to plan video preview: %v", err)
+		c.JSON(200, M{"success": false, "value": "failed to plan video preview: " + err.Error()})
 		return
 	}
 
-	// Upload video preview to destination
-	objectName := path.Join(destinationServer.ObjectName, previewFileName)
-	err = queries.StorageFileUpload(c, destinationServer, previewFilePath, objectName)
+	// Create video previews
+	_ = os.MkdirAll(filepath.Join(tmpDir, "previews"), os.ModePerm)
+	var previews []videoPreview
+	var failedPreviews []string
+	previews, failedPreviews, err = CreateVideoPreview(source, params.Format, filepath.Join(tmpDir, "previews"))
 	if err != nil {
-		log.Printf("Failed to upload video preview: %v", err)
-		c.JSON(200, M{"success": false, "value": "failed to upload video preview: " + err.Error()})
+		log.Printf("Failed to create video preview: %v", err)
+		c.JSON(200, M{"success": false, "value": "failed to create video preview: " + err.Error()})
 		return
 	}
 
-	c.JSON(200, M{"success": true})
+	// Upload video previews to destination
+	var previewFormats = make([]string, 0, len(previews))
+	var renditions = make([]types.VideoPreviewFile, 0, len(previews))
+	for _, preview := range previews {
+		objectName := path.Join(destinationServer.ObjectName, filepath.Base(preview.file))
+		err = queries.StorageFileUpload(c, destinationServer, preview.file, objectName)
+		if err != nil {
+			log.Printf("Failed to upload video preview: %v", err)
+			c.JSON(200, M{"success": false, "value": "failed to upload video preview: " + err.Error()})
+			return
+		}
+		if !slices.Contains(previewFormats, preview.format) {
+			previewFormats = append(previewFormats, preview.format)
+		}
+		renditions = append(renditions, preview.info())
+	}
+
+	var animatedPreview string
+	if params.Format.CreateAnimatedPreview {
+		var animatedFile string
+		animatedFile, err = CreateAnimatedPreview(source, params.Format, filepath.Join(tmpDir, "previews"))
+		if err != nil {
+			log.Printf("Failed to create animated preview: %v", err)
+			c.JSON(200, M{"success": false, "value": "failed to create animated preview: " + err.Error()})
+			return
+		}
+		objectName := path.Join(destinationServer.ObjectName, filepath.Base(animatedFile))
+		err = queries.StorageFileUpload(c, destinationServer, animatedFile, objectName)
+		if err != nil {
+			log.Printf("Failed to upload animated preview: %v", err)
+			c.JSON(200, M{"success": false, "value": "failed to upload animated preview: " + err.Error()})
+			return
+		}
+		animatedPreview = filepath.Base(animatedFile)
+	}
+
+	c.JSON(200, M{"success": true, "value": M{"video_formats": previewFormats, "renditions": renditions,
+		"failed_previews": failedPreviews, "animated_preview": animatedPreview, "plan": source.PreviewPlan}})
 }
@@ -142,6 +142,8 @@ func makeImagesHandler(c *gin.Context) {
 	}*/
 	var items = make([]string, 0, 300)
 	var previewItems = make([]string, 0, 300)
+	var scores []helpers.ImageScore
+	filter := newFrameFilter(params.Format.FrameQuality)
 	for _, f := range filenames {
 		if params.Format.MaxAmount > 0 && numCreated >= params.Format.MaxAmount {
 			break
@@ -149,6 +151,10 @@ func makeImagesHandler(c *gin.Context) {
 		m, _ := mimetype.DetectFile(f)
 		mimeType := m.String()
 		if lo.Contains(imageTypes, mimeType) {
+			score, hash, duplicate, remember := filter.checkImage(f)
+			if duplicate {
+				continue
+			}
 			var size string
 			var previewSize string
 			size, previewSize, err = processImage(f)
@@ -160,6 +166,12 @@ func makeImagesHandler(c *gin.Context) {
 				c.JSON(200, M{"success": false, "value": err.Error()})
 				return
 			}
+			if remember {
+				filter.add(hash)
+			}
+			if filter.quality.Enabled() {
+				scores = append(scores, score)
+			}
 			items = append(items, size)
 			previewItems = append(previewItems, previewSize)
 			continue
@@ -171,24 +183,29 @@ func makeImagesHandler(c *gin.Context) {
 			if maxFrames < 0 {
 				maxFrames = 0
 			}
-			err = doExtractFrames2(f, filepath.Join(tmpDir, "frames"), maxFrames, params.Format.MinTimeInterval, true)
+			var frames []scoredFrame
+			if len(params.Timestamps) > 0 {
+				// Explicit timestamps replace automatic selection and amount limits
+				frames, err = extractFramesAt(f, filepath.Join(tmpDir, "frames"), params.Timestamps, filter)
+			} else {
+				frames, err = extractScoredFrames(f, filepath.Join(tmpDir, "frames"), maxFrames, params.Format.MinTimeInterval, true,
+					params.Format.KeyframesOnly, filter)
+			}
 			if err != nil {
 				log.Println(err)
 				c.JSON(200, M{"success": false, "value": err.Error()})
 				return
 			}
-			var frameFiles []string
-			frameFiles, _ = filepath.Glob(filepath.Join(tmpDir, "frames", "*"))
 			/*if params.Format.MaxAmount > 0 {
-				frameFiles = lo.Shuffle(frameFiles)
+				frames = lo.Shuffle(frames)
 			}*/
-			for _, f := range frameFiles {
-				if params.Format.MaxAmount > 0 && numCreated >= params.Format.MaxAmount {
+			for _, frame := range frames {
+				if len(params.Timestamps) == 0 && params.Format.MaxAmount > 0 && numCreated >= params.Format.MaxAmount {
 					break
 				}
 				var size string
 				var previewSize string
-				size, previewSize, err = processImage(f)
+				size, previewSize, err = processImage(frame.file)
 				if err != nil {
 					if err == errorLowRes {
 						continue
@@ -199,6 +216,9 @@ func makeImagesHandler(c *gin.Context) {
 				}
 				items = append(items, size)
 				previewItems = append(previewItems, previewSize)
+				if filter.quality.Enabled() {
+					scores = append(scores, frame.score)
+				}
 			}
 		}
 	}
@@ -253,5 +273,5 @@ func makeImagesHandler(c *gin.Context) {
 		}
 	}
 	success = true
-	c.JSON(200, M{"success": true, "value": M{"items": items, "preview_items": previewItems}})
+	c.JSON(200, M{"success": true, "value": M{"items": items, "preview_items": previewItems, "scores": scores}})
 }
@@ -23,6 +23,7 @@ import (
 	_ "golang.org/x/image/bmp"
 	_ "golang.org/x/image/webp"
 
+	"github.com/totaltube/conversion/helpers"
 	"github.com/totaltube/conversion/queries"
 	"github.com/totaltube/conversion/types"
 )
@@ -112,8 +113,15 @@ func makeThumbsHandler(c *gin.Context) {
 	size := fmt.Sprintf("%dx%d", params.Format.Size.Width, params.Format.Size.Height)
 	retina := false
 	videoPreviewCreated := false
+	var videoPreviewFormats []string
+	var videoPreviewRenditions []types.VideoPreviewFile
+	var videoPreviewFailed []string
+	var animatedPreview string
+	var videoPreviewPlan types.PreviewPlan
 	hasVideoFiles := false
-	var processImage = func(imageFile string) error {
+	var scores []helpers.ImageScore
+	filter := newFrameFilter(params.Format.FrameQuality)
+	var processImage = func(imageFile string, score helpers.ImageScore) error {
 		reader, _ := os.Open(imageFile)
 		defer reader.Close()
 		im, _, err := image.DecodeConfig(reader)
@@ -153,6 +161,9 @@ func makeThumbsHandler(c *gin.Context) {
 				return err
 			}
 		}
+		if filter.quality.Enabled() {
+			scores = append(scores, score)
+		}
 		numCreated++
 		return nil
 	}
@@ -182,12 +193,20 @@ func makeThumbsHandler(c *gin.Context) {
 		m, _ := mimetype.DetectFile(f)
 		mimeType := m.String()
 		if lo.Contains(imageTypes, mimeType) {
-			err = processImage(f)
+			score, hash, duplicate, remember := filter.checkImage(f)
+			if duplicate {
+				continue
+			}
+			created := numCreated
+			err = processImage(f, score)
 			if err != nil {
 				log.Println(err)
 				c.JSON(200, M{"success": false, "value": err.Error()})
 				return
 			}
+			if remember && numCreated > created {
+				filter.add(hash)
+			}
 			continue
 		}
 		if lo.Contains(videoTypes, mimeType) {
@@ -198,26 +217,30 @@ func makeThumbsHandler(c *gin.Context) {
 			if maxFrames < 0 {
 				maxFrames = 0
 			}
-			err = doExtractFrames2(f, filepath.Join(tmpDir, "frames"), maxFrames, params.Format.MinTimeInterval, true)
+			var frames []scoredFrame
+			if len(params.Timestamps) > 0 {
+				// Explicit timestamps replace automatic selection and amount limits
+				frames, err = extractFramesAt(f, filepath.Join(tmpDir, "frames"), params.Timestamps, filter)
+			} else {
+				frames, err = extractScoredFrames(f, filepath.Join(tmpDir, "frames"), maxFrames, params.Format.MinTimeInterval, true,
+					params.Format.KeyframesOnly, filter)
+			}
 			if err != nil {
 				log.Println(err)
 				c.JSON(200, M{"success": false, "value": err.Error()})
 				return
 			}
-			var frameFiles []string
-			frameFiles, _ = filepath.Glob(filepath.Join(tmpDir, "frames", "*"))
-			slices.Sort(frameFiles)
 			/*if params.MaxThumbs > 0 {
-				frameFiles = lo.Shuffle(frameFiles)
+				frames = lo.Shuffle(frames)
 			}*/
-			for _, f := range frameFiles {
-				if params.Format.MaxThumbs > 0 && numCreated >= params.Format.MaxThumbs {
+			for _, frame := range frames {
+				if len(params.Timestamps) == 0 && params.Format.MaxThumbs > 0 && numCreated >= params.Format.MaxThumbs {
 					break
 				}
-				if params.MaxThumbs > 0 && numCreated >= params.MaxThumbs {
+				if len(params.Timestamps) == 0 && params.MaxThumbs > 0 && numCreated >= params.MaxThumbs {
 					break
 				}
-				err = processImage(f)
+				err = processImage(frame.file, frame.score)
 				if err != nil {
 					log.Println(err)
 					c.JSON(200, M{"success": false, "value": err.Error()})
@@ -228,7 +251,7 @@ func makeThumbsHandler(c *gin.Context) {
 	}
 
 	// Create video preview if requested
-	if params.Format.CreateVideoPreview {
+	if params.Format.CreateVideoPreview || params.Format.CreateAnimatedPreview {
 		var videoSourceFile string
 
 		// If video_source is specified, use it for video preview
@@ -266,27 +289,57 @@ func makeThumbsHandler(c *gin.Context) {
 			}
 		}
 
-		if videoSourceFile != "" {
-			previewFileName := fmt.Sprintf("video-preview-%s.mp4", params.Format.Name)
-			previewFilePath := filepath.Join(tmpDir, previewFileName)
-			err = CreateVideoPreview(videoSourceFile, tmpDir, params.Format, previewFilePath)
+		_ = os.MkdirAll(filepath.Join(tmpDir, "previews"), os.ModePerm)
+		// Segments are planned once, video and animated previews use the same ones
+		var source previewSource
+		if videoSourceFile != "" && (params.Format.CreateVideoPreview || params.Format.CreateAnimatedPreview) {
+			if source, err = planVideoPreview(videoSourceFile, tmpDir, params.Format); err != nil {
+				log.Printf("Failed to plan video preview: %v", err)
+				videoSourceFile = ""
+			} else {
+				videoPreviewPlan = source.PreviewPlan
+			}
+		}
+		if videoSourceFile != "" && params.Format.CreateVideoPreview {
+			var previews []videoPreview
+			previews, videoPreviewFailed, err = CreateVideoPreview(source, params.Format, filepath.Join(tmpDir, "previews"))
 			if err != nil {
 				log.Printf("Failed to create video preview: %v", err)
 				// Continue without preview, videoPreviewCreated remains false
-			} else {
-				videoPreviewCreated = true
-				// Upload video preview to destinationVideoPreviewServer if available
-				if destinationVideoPreviewServer != nil {
-					objectName := path.Join(destinationVideoPreviewServer.ObjectName, previewFileName)
-					err = queries.StorageFileUpload(c, destinationVideoPreviewServer, previewFilePath, objectName)
+			} else if destinationVideoPreviewServer != nil {
+				// Upload video previews to destinationVideoPreviewServer if available
+				for _, preview := range previews {
+					objectName := path.Join(destinationVideoPreviewServer.ObjectName, filepath.Base(preview.file))
+					err = queries.StorageFileUpload(c, destinationVideoPreviewServer, preview.file, objectName)
 					if err != nil {
 						log.Printf("Failed to upload video preview: %v", err)
-						videoPreviewCreated = false
+						continue
+					}
+					if !slices.Contains(videoPreviewFormats, preview.format) {
+						videoPreviewFormats = append(videoPreviewFormats, preview.format)
 					}
+					videoPreviewRenditions = append(videoPreviewRenditions, preview.info())
+				}
+				videoPreviewCreated = len(videoPreviewFormats) > 0
+			} else {
+				log.Printf("No destination video preview server configured")
+			}
+		}
+		if videoSourceFile != "" && params.Format.CreateAnimatedPreview {
+			var animatedFile string
+			animatedFile, err = CreateAnimatedPreview(source, params.Format, filepath.Join(tmpDir, "previews"))
+			if err != nil {
+				log.Printf("Failed to create animated preview: %v", err)
+			} else if destinationVideoPreviewServer != nil {
+				objectName := path.Join(destinationVideoPreviewServer.ObjectName, filepath.Base(animatedFile))
+				err = queries.StorageFileUpload(c, destinationVideoPreviewServer, animatedFile, objectName)
+				if err != nil {
+					log.Printf("Failed to upload animated preview: %v", err)
 				} else {
-					log.Printf("No destination video preview server configured")
-					videoPreviewCreated = false
+					animatedPreview = filepath.Base(animatedFile)
 				}
+			} else {
+				log.Printf("No destination video preview server configured")
 			}
 		}
 	}
@@ -324,5 +377,7 @@ func makeThumbsHandler(c *gin.Context) {
 		}
 	}
 	success = true
-	c.JSON(200, M{"success": true, "value": M{"num_created": numCreated, "retina": retina, "video_preview": videoPreviewCreated}})
+	c.JSON(200, M{"success": true, "value": M{"num_created": numCreated, "retina": retina, "scores": scores, "video_preview": videoPreviewCreated,
+		"video_preview_formats": videoPreviewFormats, "video_preview_renditions": videoPreviewRenditions,
+		"video_preview_failed": videoPreviewFailed, "animated_preview": animatedPreview, "video_preview_plan": videoPreviewPlan}})
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/totaltube/conversion/queries"
+	"github.com/totaltube/conversion/types"
+)
+
+func makeTimelineHandler(c *gin.Context) {
+	var params types.MakeTimelineRequest
+	err := c.BindJSON(&params)
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	if params.Format.Name == "" {
+		c.JSON(200, M{"success": false, "value": "format name is required"})
+		return
+	}
+	if params.Format.TimelineSize.Width <= 0 || params.Format.TimelineSize.Height <= 0 {
+		c.JSON(200, M{"success": false, "value": "timeline size is required"})
+		return
+	}
+	if params.Format.TimelineMaxAmount <= 0 && params.Format.TimelineMinInterval <= 0 {
+		c.JSON(200, M{"success": false, "value": "timeline max amount or min interval is required"})
+		return
+	}
+	if params.Format.TimelineType == "" {
+		params.Format.TimelineType = "jpg"
+	}
+	if !slices.Contains(timelineTypes, params.Format.TimelineType) {
+		c.JSON(200, M{"success": false, "value": "wrong timeline type " + params.Format.TimelineType})
+		return
+	}
+	var tmpDir string
+	tmpDir, err = os.MkdirTemp(conversionPath, "make_timeline_")
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	var sourceServer *types.S3Server
+	if sourceServer, err = types.S3FromURL(params.Source); err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": "wrong source server url: " + err.Error()})
+		return
+	}
+	var destinationServer *types.S3Server
+	if destinationServer, err = types.S3FromURL(params.Destination); err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": "wrong destination server url: " + err.Error()})
+		return
+	}
+	var sourceFileInfos []queries.FileInfo
+	if sourceFileInfos, err = queries.StorageListWithSort(c, sourceServer, sourceServer.ObjectName, "size"); err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	// Find the largest mp4 or webm file that starts with "video-"
+	var selectedFileInfo *queries.FileInfo
+	for _, fileInfo := range sourceFileInfos {
+		baseName := filepath.Base(fileInfo.Name)
+		ext := strings.ToLower(filepath.Ext(baseName))
+		if (ext == ".mp4" || ext == ".webm") && strings.HasPrefix(baseName, "video-") {
+			selectedFileInfo = &fileInfo
+			break // Since list is sorted by size descending, first match is the largest
+		}
+	}
+	if selectedFileInfo == nil {
+		c.JSON(200, M{"success": false, "value": "no suitable video files found (mp4/webm starting with video-)"})
+		return
+	}
+	_ = os.MkdirAll(filepath.Join(tmpDir, "sources"), os.ModePerm)
+	localPath := filepath.Join(tmpDir, "sources", filepath.Base(selectedFileInfo.Name))
+	err = queries.StorageFileGet(c, sourceServer, selectedFileInfo.Name, localPath)
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": "failed to download video file: " + err.Error()})
+		return
+	}
+	var fileFormat types.FileFormat
+	fileFormat, err = probeFile(localPath)
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	duration, _ := strconv.ParseFloat(fileFormat.Format.Duration, 64)
+	_ = os.MkdirAll(filepath.Join(tmpDir, "result"), os.ModePerm)
+	var info types.ContentVideoInfo
+	err = CreateVideoTimeline(localPath, tmpDir, filepath.Join(tmpDir, "result"), duration, params.Format, &info)
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": "timeline create error: " + err.Error()})
+		return
+	}
+	// Done. Uploading to the server
+	var success = false
+	defer func() {
+		if !success {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+			defer cancel()
+			list, err1 := queries.StorageList(ctx, destinationServer, destinationServer.ObjectName)
+			if err1 != nil {
+				log.Println(err1)
+				return
+			}
+			for _, entry := range list {
+				if strings.HasPrefix(path.Base(entry), fmt.Sprintf("timeline-%s.", params.Format.Name)) {
+					err1 = queries.StorageDelete(ctx, destinationServer, entry)
+					if err1 != nil {
+						log.Println(err1)
+					}
+				}
+			}
+		}
+	}()
+	var resultFiles []string
+	resultFiles, _ = filepath.Glob(filepath.Join(tmpDir, "result", "*"))
+	for _, f := range resultFiles {
+		objectName := path.Join(destinationServer.ObjectName, filepath.Base(f))
+		err = queries.StorageFileUpload(c, destinationServer, f, objectName)
+		if err != nil {
+			log.Println(err)
+			c.JSON(200, M{"success": false, "value": err.Error()})
+			return
+		}
+	}
+	success = true
+	c.JSON(200, M{"success": true, "value": M{
+		"timeline_type":    info.TimelineType,
+		"timeline_size":    info.TimelineSize,
+		"timeline_frames":  info.TimelineFrames,
+		"timeline_sheets":  info.TimelineSheets,
+		"timeline_columns": info.TimelineColumns,
+	}})
+}
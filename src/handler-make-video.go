@@ -26,6 +26,10 @@ func makeVideoHandler(c *gin.Context) {
 		c.JSON(200, M{"success": false, "value": err.Error()})
 		return
 	}
+	if params.Format.Type == "hls" && params.Format.HLSEncrypt && params.Format.HLSKeyURI == "" {
+		c.JSON(200, M{"success": false, "value": "hls key uri is required for encrypted hls"})
+		return
+	}
 
 	var tmpDir string
 	tmpDir, err = os.MkdirTemp(conversionPath, "make_video_")
@@ -62,6 +66,14 @@ func makeVideoHandler(c *gin.Context) {
 	} else {
 		posterDestinationServer = destinationServer
 	}
+	var keyDestinationServer *types.S3Server
+	if params.KeyDestination != "" {
+		if keyDestinationServer, err = types.S3FromURL(params.KeyDestination); err != nil {
+			log.Println(err)
+			c.JSON(200, M{"success": false, "value": "wrong key destination server url: " + err.Error()})
+			return
+		}
+	}
 	/*hostPort = strings.Split(destinationServer.Endpoint, ":")
 	if hostPort[0] == "localhost" || hostPort[0] == "127.0.0.1" {
 		hostPort[0] = "host.docker.internal"
@@ -85,19 +97,7 @@ func makeVideoHandler(c *gin.Context) {
 	filenames, _ := filepath.Glob(filepath.Join(tmpDir, "sources", "*"))
 	var sourceNames = make([]string, 0, len(filenames))
 	for _, filename := range filenames {
-		var mimeType string
-		ext := filepath.Ext(filename)
-		if ext == ".mp4" {
-			mimeType = "video/mp4"
-		} else if ext == ".webm" {
-			mimeType = "video/webm"
-		} else {
-			m, err := mimetype.DetectFile(filename)
-			if err != nil {
-				log.Println(err)
-			}
-			mimeType = m.String()
-		}
+		mimeType := videoSourceMimeType(filename)
 		if lo.Contains(videoTypes, mimeType) {
 			sourceNames = append(sourceNames, filename)
 		} else {
@@ -132,7 +132,12 @@ func makeVideoHandler(c *gin.Context) {
 			for _, entry := range list {
 				if strings.HasPrefix(path.Base(entry), fmt.Sprintf("video-%s.", params.Format.Name)) ||
 					strings.HasPrefix(path.Base(entry), fmt.Sprintf("poster-%s.", params.Format.Name)) ||
-					strings.HasPrefix(path.Base(entry), fmt.Sprintf("timeline-%s.", params.Format.Name)) {
+					strings.HasPrefix(path.Base(entry), fmt.Sprintf("poster-%s-", params.Format.Name)) ||
+					strings.HasPrefix(path.Base(entry), fmt.Sprintf("timeline-%s.", params.Format.Name)) ||
+					strings.HasPrefix(path.Base(entry), fmt.Sprintf("chapters-%s.", params.Format.Name)) ||
+					strings.HasPrefix(path.Base(entry), fmt.Sprintf("chapter-%s.", params.Format.Name)) ||
+					strings.HasPrefix(path.Base(entry), fmt.Sprintf("iframes-%s.", params.Format.Name)) ||
+					strings.HasPrefix(path.Base(entry), fmt.Sprintf("master-%s.", params.Format.Name)) {
 					err1 = queries.StorageDelete(ctx, destinationServer, entry)
 					if err1 != nil {
 						log.Println(err1)
@@ -145,13 +150,21 @@ func makeVideoHandler(c *gin.Context) {
 				return
 			}
 			for _, entry := range list {
-				if strings.HasPrefix(path.Base(entry), fmt.Sprintf("poster-%s.", params.Format.Name)) {
+				if strings.HasPrefix(path.Base(entry), fmt.Sprintf("poster-%s.", params.Format.Name)) ||
+					strings.HasPrefix(path.Base(entry), fmt.Sprintf("poster-%s-", params.Format.Name)) {
 					err1 = queries.StorageDelete(ctx, posterDestinationServer, entry)
 					if err1 != nil {
 						log.Println(err1)
 					}
 				}
 			}
+			if keyDestinationServer != nil {
+				err1 = queries.StorageDelete(ctx, keyDestinationServer,
+					path.Join(keyDestinationServer.ObjectName, fmt.Sprintf("key-%s.key", params.Format.Name)))
+				if err1 != nil {
+					log.Println(err1)
+				}
+			}
 		}
 	}()
 	var resultFiles []string
@@ -168,6 +181,21 @@ func makeVideoHandler(c *gin.Context) {
 			}
 			continue
 		}
+		if strings.HasPrefix(filepath.Base(f), "key-") {
+			// Encryption key is never uploaded next to the video
+			if keyDestinationServer == nil {
+				continue
+			}
+			objectName = path.Join(keyDestinationServer.ObjectName, filepath.Base(f))
+			err = queries.StorageFileUpload(c, keyDestinationServer, f, objectName)
+			if err != nil {
+				log.Println(err)
+				c.JSON(200, M{"success": false, "value": err.Error()})
+				return
+			}
+			info.HLSKey = ""
+			continue
+		}
 		err = queries.StorageFileUpload(c, destinationServer, f, objectName)
 		if err != nil {
 			log.Println(err)
@@ -178,3 +206,18 @@ func makeVideoHandler(c *gin.Context) {
 	success = true
 	c.JSON(200, M{"success": true, "value": info})
 }
+
+// videoSourceMimeType detects mime type of the source file, mp4 and webm are trusted by extension
+func videoSourceMimeType(filename string) string {
+	ext := filepath.Ext(filename)
+	if ext == ".mp4" {
+		return "video/mp4"
+	} else if ext == ".webm" {
+		return "video/webm"
+	}
+	m, err := mimetype.DetectFile(filename)
+	if err != nil {
+		log.Println(err)
+	}
+	return m.String()
+}
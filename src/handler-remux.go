@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/totaltube/conversion/queries"
+	"github.com/totaltube/conversion/types"
+)
+
+func remuxHandler(c *gin.Context) {
+	var params types.RemuxRequest
+	err := c.BindJSON(&params)
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	var tmpDir string
+	tmpDir, err = os.MkdirTemp(conversionPath, "remux_")
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	var sourceServer *types.S3Server
+	if sourceServer, err = types.S3FromURL(params.Source); err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": "wrong source server url: " + err.Error()})
+		return
+	}
+	var destinationServer *types.S3Server
+	if destinationServer, err = types.S3FromURL(params.Destination); err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": "wrong destination server url: " + err.Error()})
+		return
+	}
+	_ = os.MkdirAll(filepath.Join(tmpDir, "sources"), os.ModePerm)
+	var sourceFilename = filepath.Join(tmpDir, "sources", filepath.Base(sourceServer.ObjectName))
+	err = queries.StorageFileGet(c, sourceServer, sourceServer.ObjectName, sourceFilename)
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	_ = os.MkdirAll(filepath.Join(tmpDir, "result"), os.ModePerm)
+	var info types.ContentVideoInfo
+	info, err = RemuxVideo(sourceFilename, filepath.Join(tmpDir, "result"), params.Format)
+	if err != nil {
+		log.Println(err)
+		c.JSON(200, M{"success": false, "value": err.Error()})
+		return
+	}
+	// Done. Uploading to the server
+	var success = false
+	defer func() {
+		if !success {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+			defer cancel()
+			list, err1 := queries.StorageList(ctx, destinationServer, destinationServer.ObjectName)
+			if err1 != nil {
+				log.Println(err1)
+				return
+			}
+			for _, entry := range list {
+				if strings.HasPrefix(path.Base(entry), fmt.Sprintf("video-%s.", params.Format.Name)) {
+					err1 = queries.StorageDelete(ctx, destinationServer, entry)
+					if err1 != nil {
+						log.Println(err1)
+					}
+				}
+			}
+		}
+	}()
+	var resultFiles []string
+	resultFiles, _ = filepath.Glob(filepath.Join(tmpDir, "result", "*"))
+	for _, f := range resultFiles {
+		objectName := path.Join(destinationServer.ObjectName, filepath.Base(f))
+		err = queries.StorageFileUpload(c, destinationServer, f, objectName)
+		if err != nil {
+			log.Println(err)
+			c.JSON(200, M{"success": false, "value": err.Error()})
+			return
+		}
+	}
+	success = true
+	c.JSON(200, M{"success": true, "value": info})
+}
@@ -0,0 +1,157 @@
+package helpers
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// placeholderMaxWidth is the width images are sampled down to before computing placeholders
+const placeholderMaxWidth = 64
+
+// BlurHash encodes the image into a blurhash placeholder string (https://blurha.sh)
+// with xComponents x yComponents components, each between 1 and 9.
+func BlurHash(im image.Image, xComponents int, yComponents int) string {
+	xComponents = max(1, min(9, xComponents))
+	yComponents = max(1, min(9, yComponents))
+	pixels, width, height := sampleRGB(im, placeholderMaxWidth)
+	if width == 0 || height == 0 {
+		return ""
+	}
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var factor [3]float64
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+					pixel := pixels[y*width+x]
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * sRGBToLinear(pixel[c])
+					}
+				}
+			}
+			scale := 1 / float64(width*height)
+			for c := 0; c < 3; c++ {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+	var hash strings.Builder
+	hash.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		var actualMaximumValue float64
+		for _, factor := range factors[1:] {
+			for c := 0; c < 3; c++ {
+				actualMaximumValue = math.Max(actualMaximumValue, math.Abs(factor[c]))
+			}
+		}
+		quantisedMaximumValue := max(0, min(82, int(math.Floor(actualMaximumValue*166-0.5))))
+		maximumValue = float64(quantisedMaximumValue+1) / 166
+		hash.WriteString(encode83(quantisedMaximumValue, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(encode83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		var quantised [3]int
+		for c := 0; c < 3; c++ {
+			quantised[c] = max(0, min(18, int(math.Floor(signPow(factor[c]/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encode83(quantised[0]*19*19+quantised[1]*19+quantised[2], 2))
+	}
+	return hash.String()
+}
+
+// DominantColor returns the most common color of the image as #rrggbb.
+// Colors are grouped into buckets of 16 levels per channel and the average of the largest bucket is returned.
+func DominantColor(im image.Image) string {
+	pixels, _, _ := sampleRGB(im, placeholderMaxWidth)
+	if len(pixels) == 0 {
+		return ""
+	}
+	type bucket struct {
+		count int
+		sum   [3]int
+	}
+	var buckets = make(map[int]*bucket)
+	var best *bucket
+	for _, pixel := range pixels {
+		key := pixel[0]>>4<<8 | pixel[1]>>4<<4 | pixel[2]>>4
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{}
+			buckets[key] = b
+		}
+		b.count++
+		for c := 0; c < 3; c++ {
+			b.sum[c] += pixel[c]
+		}
+		if best == nil || b.count > best.count {
+			best = b
+		}
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.sum[0]/best.count, best.sum[1]/best.count, best.sum[2]/best.count)
+}
+
+// sampleRGB returns 8-bit RGB values of the image sampled down to maxWidth
+func sampleRGB(im image.Image, maxWidth int) (pixels [][3]int, width int, height int) {
+	bounds := im.Bounds()
+	if bounds.Empty() {
+		return
+	}
+	step := 1
+	if bounds.Dx() > maxWidth {
+		step = (bounds.Dx() + maxWidth - 1) / maxWidth
+	}
+	width = (bounds.Dx() + step - 1) / step
+	height = (bounds.Dy() + step - 1) / step
+	pixels = make([][3]int, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := im.At(x, y).RGBA()
+			pixels = append(pixels, [3]int{int(r >> 8), int(g >> 8), int(b >> 8)})
+		}
+	}
+	return
+}
+
+func encode83(value int, length int) string {
+	var result = make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(result)
+}
+
+func sRGBToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
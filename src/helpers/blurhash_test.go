@@ -0,0 +1,45 @@
+package helpers
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			black.Set(x, y, color.RGBA{A: 255})
+		}
+	}
+	if hash := BlurHash(black, 4, 3); hash != "L00000fQfQfQfQfQfQfQfQfQfQfQ" {
+		t.Errorf("wrong blurhash of black image: %s", hash)
+	}
+	red := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			red.Set(x, y, color.RGBA{R: 255, A: 255})
+		}
+	}
+	// characters 2-5 encode the average color, 0xff0000 for the red image
+	if hash := BlurHash(red, 4, 3); len(hash) != 28 || hash[2:6] != "TI:j" {
+		t.Errorf("wrong blurhash of red image: %s", hash)
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	im := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 10 {
+				im.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				im.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	if c := DominantColor(im); c != "#0000ff" {
+		t.Errorf("dominant color should be blue, got %s", c)
+	}
+}
@@ -0,0 +1,43 @@
+package helpers
+
+import (
+	"image"
+	"math/bits"
+)
+
+// DHash returns 64 bit difference hash of the image: luma of 9x8 cells compared with the right neighbour.
+// Near duplicate images have hashes within a small HammingDistance.
+func DHash(im image.Image) (hash uint64) {
+	gray, width, height := grayscale(im, 288)
+	if width < 9 || height < 8 {
+		return
+	}
+	var cells [8][9]float64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			x0, x1 := x*width/9, (x+1)*width/9
+			y0, y1 := y*height/8, (y+1)*height/8
+			var sum float64
+			for yy := y0; yy < y1; yy++ {
+				for xx := x0; xx < x1; xx++ {
+					sum += gray[yy*width+xx]
+				}
+			}
+			cells[y][x] = sum / float64((x1-x0)*(y1-y0))
+		}
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if cells[y][x] < cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return
+}
+
+// HammingDistance returns the amount of differing bits of two hashes
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,27 @@
+package helpers
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDHash(t *testing.T) {
+	gradient := image.NewGray(image.Rect(0, 0, 90, 80))
+	brighter := image.NewGray(image.Rect(0, 0, 90, 80))
+	mirrored := image.NewGray(image.Rect(0, 0, 90, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 90; x++ {
+			v := uint8((x*2 + y) % 200)
+			gradient.SetGray(x, y, color.Gray{Y: v})
+			brighter.SetGray(x, y, color.Gray{Y: v + 40})
+			mirrored.SetGray(89-x, y, color.Gray{Y: v})
+		}
+	}
+	if d := HammingDistance(DHash(gradient), DHash(brighter)); d > 4 {
+		t.Errorf("brightness change should keep the hash, distance %d", d)
+	}
+	if d := HammingDistance(DHash(gradient), DHash(mirrored)); d < 16 {
+		t.Errorf("mirrored image should have a distant hash, distance %d", d)
+	}
+}
@@ -0,0 +1,116 @@
+package helpers
+
+import (
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// scoreMaxWidth is the width images are sampled down to before scoring
+const scoreMaxWidth = 320
+
+// ImageScore describes visual quality of an image. All values are in 0..1 range.
+type ImageScore struct {
+	Sharpness  float64 `json:"sharpness"`
+	Brightness float64 `json:"brightness"`
+	Contrast   float64 `json:"contrast"`
+	Entropy    float64 `json:"entropy"`
+	Score      float64 `json:"score"`
+}
+
+// ScoreImageFile decodes the image and scores it with ScoreImage
+func ScoreImageFile(imagePath string) (score ImageScore, err error) {
+	var im image.Image
+	im, err = DecodeImageFile(imagePath)
+	if err != nil {
+		return
+	}
+	score = ScoreImage(im)
+	return
+}
+
+// DecodeImageFile opens and decodes the image
+func DecodeImageFile(imagePath string) (im image.Image, err error) {
+	var file *os.File
+	file, err = os.Open(imagePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	im, _, err = image.Decode(file)
+	if err != nil {
+		err = errors.Wrap(err, "can't decode image "+imagePath)
+	}
+	return
+}
+
+// ScoreImage rates the image by sharpness (variance of laplacian), mean brightness, contrast (luma deviation)
+// and entropy of the luma histogram, low for uniform images. Blurry, too dark or too bright and flat images get low Score.
+func ScoreImage(im image.Image) (score ImageScore) {
+	gray, width, height := grayscale(im, scoreMaxWidth)
+	if width < 3 || height < 3 {
+		return
+	}
+	var sum, sumSquares float64
+	var histogram [256]int
+	for _, v := range gray {
+		sum += v
+		sumSquares += v * v
+		histogram[min(255, int(v))]++
+	}
+	count := float64(len(gray))
+	for _, n := range histogram {
+		if n > 0 {
+			p := float64(n) / count
+			score.Entropy -= p * math.Log2(p)
+		}
+	}
+	score.Entropy /= 8
+	mean := sum / count
+	score.Brightness = mean / 255
+	score.Contrast = math.Min(1, math.Sqrt(math.Max(0, sumSquares/count-mean*mean))/128)
+	var lapSum, lapSumSquares float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			lap := gray[i-width] + gray[i+width] + gray[i-1] + gray[i+1] - 4*gray[i]
+			lapSum += lap
+			lapSumSquares += lap * lap
+		}
+	}
+	lapCount := float64((width - 2) * (height - 2))
+	lapVariance := lapSumSquares/lapCount - (lapSum/lapCount)*(lapSum/lapCount)
+	score.Sharpness = lapVariance / (lapVariance + 300)
+	brightnessFactor := 1.0
+	if score.Brightness < 0.2 {
+		brightnessFactor = score.Brightness / 0.2
+	} else if score.Brightness > 0.85 {
+		brightnessFactor = (1 - score.Brightness) / 0.15
+	}
+	contrastFactor := math.Min(1, score.Contrast/0.2)
+	score.Score = score.Sharpness * brightnessFactor * contrastFactor
+	return
+}
+
+// grayscale returns luma values of the image sampled down to maxWidth
+func grayscale(im image.Image, maxWidth int) (gray []float64, width int, height int) {
+	bounds := im.Bounds()
+	step := 1
+	if bounds.Dx() > maxWidth {
+		step = (bounds.Dx() + maxWidth - 1) / maxWidth
+	}
+	width = (bounds.Dx() + step - 1) / step
+	height = (bounds.Dy() + step - 1) / step
+	gray = make([]float64, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := im.At(x, y).RGBA()
+			gray = append(gray, (0.299*float64(r)+0.587*float64(g)+0.114*float64(b))/257)
+		}
+	}
+	return
+}
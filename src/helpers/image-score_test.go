@@ -0,0 +1,33 @@
+package helpers
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestScoreImage(t *testing.T) {
+	flat := image.NewGray(image.Rect(0, 0, 64, 64))
+	checker := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			flat.SetGray(x, y, color.Gray{Y: 128})
+			if (x/4+y/4)%2 == 0 {
+				checker.SetGray(x, y, color.Gray{Y: 40})
+			} else {
+				checker.SetGray(x, y, color.Gray{Y: 220})
+			}
+		}
+	}
+	flatScore := ScoreImage(flat)
+	checkerScore := ScoreImage(checker)
+	if flatScore.Score != 0 {
+		t.Errorf("flat image score should be zero, got %f", flatScore.Score)
+	}
+	if flatScore.Entropy != 0 || checkerScore.Entropy <= 0 {
+		t.Errorf("entropy should be zero for flat image only, got %f and %f", flatScore.Entropy, checkerScore.Entropy)
+	}
+	if checkerScore.Score <= 0.5 {
+		t.Errorf("detailed image score should be high, got %f", checkerScore.Score)
+	}
+}
@@ -2,7 +2,9 @@ package helpers
 
 import (
 	"encoding/json"
+	"fmt"
 	"image"
+	"math"
 	"os"
 	"strconv"
 	"time"
@@ -95,3 +97,12 @@ func GetImageDimensions(imagePath string) (width int, height int, err error) {
 	height = im.Height
 	return
 }
+
+// FormatVTTTime formats seconds as WebVTT timestamp HH:MM:SS.mmm
+func FormatVTTTime(seconds float64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+
+	"github.com/totaltube/conversion/types"
+)
+
+// containerCodecs lists codecs that can be stream copied into the container without re-encoding
+var containerCodecs = map[string]struct {
+	video []string
+	audio []string
+}{
+	"mp4":  {video: []string{"h264", "hevc", "av1", "mpeg4"}, audio: []string{"aac", "mp3", "ac3", "eac3", "opus", "alac", "flac"}},
+	"mov":  {video: []string{"h264", "hevc", "mpeg4", "prores"}, audio: []string{"aac", "mp3", "ac3", "alac", "pcm_s16le"}},
+	"webm": {video: []string{"vp8", "vp9", "av1"}, audio: []string{"vorbis", "opus"}},
+	"mkv":  {video: []string{"h264", "hevc", "av1", "vp8", "vp9", "mpeg4", "theora"}, audio: []string{"aac", "mp3", "ac3", "eac3", "opus", "vorbis", "flac", "pcm_s16le"}},
+	"ogg":  {video: []string{"theora"}, audio: []string{"vorbis", "opus"}},
+}
+
+func probeFile(file string) (fileFormat types.FileFormat, err error) {
+	cmd := exec.Command("ffprobe", file, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams")
+	var out []byte
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		err = errors.New("can't run ffprobe: " + err.Error())
+		return
+	}
+	err = json.Unmarshal(out, &fileFormat)
+	if err != nil {
+		err = errors.New("can't parse ffprobe output: " + err.Error())
+		return
+	}
+	return
+}
+
+// probeStreams returns the first video and the first audio stream of the file format, if any
+func probeStreams(fileFormat types.FileFormat) (video *types.FStream, audio *types.FStream) {
+	for k := range fileFormat.Streams {
+		switch fileFormat.Streams[k].CodecType {
+		case "video":
+			if video == nil {
+				video = &fileFormat.Streams[k]
+			}
+		case "audio":
+			if audio == nil {
+				audio = &fileFormat.Streams[k]
+			}
+		}
+	}
+	return
+}
+
+// probeKeyframes returns timestamps of all video keyframes. It reads packet flags only, so nothing is decoded.
+func probeKeyframes(file string) (keyframes []float64, err error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags", "-of", "csv=p=0", file)
+	var out []byte
+	out, err = cmd.Output()
+	if err != nil {
+		err = errors.Wrap(err, "can't read keyframes of "+file)
+		return
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Split(strings.TrimSpace(line), ",")
+		if len(parts) < 2 || !strings.HasPrefix(parts[1], "K") {
+			continue
+		}
+		if t, err := strconv.ParseFloat(parts[0], 64); err == nil {
+			keyframes = append(keyframes, t)
+		}
+	}
+	return
+}
+
+// canCopyCodecs checks if video and audio codecs may be put into the container as is
+func canCopyCodecs(container string, videoCodec string, audioCodec string) bool {
+	codecs, ok := containerCodecs[container]
+	if !ok {
+		return false
+	}
+	if videoCodec != "" && !lo.Contains(codecs.video, videoCodec) {
+		return false
+	}
+	if audioCodec != "" && !lo.Contains(codecs.audio, audioCodec) {
+		return false
+	}
+	return true
+}
@@ -19,4 +19,7 @@ func setRoutes(app *gin.Engine) {
 	app.POST("/make-video", makeVideoHandler)
 	app.POST("/video-info", videoInfoHandler)
 	app.POST("/create-preview", createPreviewHandler)
+	app.POST("/make-clip", makeClipHandler)
+	app.POST("/remux", remuxHandler)
+	app.POST("/make-timeline", makeTimelineHandler)
 }
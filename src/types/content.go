@@ -53,13 +53,81 @@ func (c ContentType) String() string {
 }
 
 type ContentVideoInfo struct {
-	Type           string  `json:"type"`
-	Size           Size    `json:"size"`
-	VideoBitrate   int32   `json:"video_bitrate"`
-	AudioBitrate   int32   `json:"audio_bitrate"`
-	PosterType     string  `json:"poster_type,omitempty"`
-	TimelineType   string  `json:"timeline_type,omitempty"`
-	TimelineSize   Size    `json:"timeline_size"`
-	TimelineFrames int32   `json:"timeline_frames"`
-	Duration       float64 `json:"duration"`
+	Type            string        `json:"type"`
+	Size            Size          `json:"size"`
+	VideoBitrate    int32         `json:"video_bitrate"`
+	AudioBitrate    int32         `json:"audio_bitrate"`
+	PosterType      string        `json:"poster_type,omitempty"`
+	PosterTime      float64       `json:"poster_time,omitempty"`
+	PosterScore     float64       `json:"poster_score,omitempty"`
+	PosterSizes     []Size        `json:"poster_sizes,omitempty"`
+	PosterRetina    bool          `json:"poster_retina,omitempty"`
+	PosterBlurHash  string        `json:"poster_blurhash,omitempty"`
+	PosterColor     string        `json:"poster_color,omitempty"`
+	TimelineType    string        `json:"timeline_type,omitempty"`
+	TimelineSize    Size          `json:"timeline_size"`
+	TimelineFrames  int32         `json:"timeline_frames"`
+	TimelineSheets  int32         `json:"timeline_sheets,omitempty"`
+	TimelineColumns int32         `json:"timeline_columns,omitempty"`
+	Duration        float64       `json:"duration"`
+	StreamCopy      bool          `json:"stream_copy,omitempty"`
+	Quality         *VideoQuality `json:"quality,omitempty"`
+	SourceIssues    []string      `json:"source_issues,omitempty"`
+	SourceRepaired  bool          `json:"source_repaired,omitempty"`
+	Chapters        int32         `json:"chapters,omitempty"`
+	HLSKey          string        `json:"hls_key,omitempty"`
+	// HLSIFrames tells if iframes-<name>.m3u8 is created, it's skipped for encrypted video
+	HLSIFrames bool `json:"hls_iframes,omitempty"`
+}
+
+// TimelineFrame is an entry of timeline-<name>.json manifest: the frame timestamp, the time span
+// it covers and its rectangle in the sprite sheet
+type TimelineFrame struct {
+	Time   float64 `json:"time"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+	Sheet  string  `json:"sheet"`
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	Width  int     `json:"w"`
+	Height int     `json:"h"`
+}
+
+// PreviewSegment is a part of the source video used in the video preview
+type PreviewSegment struct {
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+}
+
+// PreviewPlan is the segment selection the video preview was made from.
+// Adaptation is set when the source is too short for the requested segments:
+// fewer_segments, shorter_segments or whole_clip played with Speed.
+type PreviewPlan struct {
+	Segments   []PreviewSegment `json:"segments"`
+	Speed      float64          `json:"speed"`
+	Adaptation string           `json:"adaptation,omitempty"`
+}
+
+// VideoPreviewFile is a created video preview file, the frontend chooses the rendition by format and pixel ratio
+type VideoPreviewFile struct {
+	File    string `json:"file"`
+	Format  string `json:"format"`
+	Size    Size   `json:"size"`
+	Bitrate int64  `json:"bitrate"`
+	Retina  bool   `json:"retina,omitempty"`
+}
+
+type VideoChapter struct {
+	Title     string  `json:"title"`
+	Start     float64 `json:"start"`
+	End       float64 `json:"end"`
+	Thumbnail string  `json:"thumbnail"`
+}
+
+type VideoQuality struct {
+	Metric  string    `json:"metric"`
+	Score   float64   `json:"score"`
+	Samples []float64 `json:"samples"`
+	// RequestedMetric is set when Metric is a fallback of unavailable requested metric
+	RequestedMetric string `json:"requested_metric,omitempty"`
 }
\ No newline at end of file
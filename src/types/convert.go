@@ -7,18 +7,24 @@ type MakeThumbsRequest struct {
 	DestinationVideoPreview string           `json:"destination_video_preview"`
 	MaxThumbs               int64            `json:"max_thumbs"`
 	Format                  ThumbFormatShort `json:"format"`
+	// Timestamps override automatic frame selection of video sources, frames are made exactly
+	// at these moments in order, without amount limits, quality replacement and deduplication
+	Timestamps []Timestamp `json:"timestamps"`
 }
 
 type MakeImagesRequest struct {
 	Source      string             `json:"source"`
 	Destination string             `json:"destination"`
 	Format      GalleryFormatShort `json:"format"`
+	// Timestamps override automatic frame selection of video sources like in MakeThumbsRequest
+	Timestamps []Timestamp `json:"timestamps"`
 }
 
 type MakeVideoRequest struct {
 	Source            string           `json:"source"`
 	Destination       string           `json:"destination"`
 	PosterDestination string           `json:"poster_destination"`
+	KeyDestination    string           `json:"key_destination"`
 	Format            VideoFormatShort `json:"format"`
 }
 
@@ -28,6 +34,33 @@ type CreatePreviewRequest struct {
 	Format      ThumbFormatShort `json:"format"`
 }
 
+// MakeTimelineRequest creates timeline sheets for the largest video-* file found by Source prefix.
+// Only timeline options of Format are used.
+type MakeTimelineRequest struct {
+	Source      string           `json:"source"`
+	Destination string           `json:"destination"`
+	Format      VideoFormatShort `json:"format"`
+}
+
 type VideoInfoRequest struct {
 	Source string `json:"source"`
 }
+
+type ClipRange struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+type MakeClipRequest struct {
+	Source            string           `json:"source"`
+	Destination       string           `json:"destination"`
+	PosterDestination string           `json:"poster_destination"`
+	Ranges            []ClipRange      `json:"ranges"`
+	Format            VideoFormatShort `json:"format"`
+}
+
+type RemuxRequest struct {
+	Source      string           `json:"source"`
+	Destination string           `json:"destination"`
+	Format      RemuxFormatShort `json:"format"`
+}
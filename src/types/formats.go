@@ -9,6 +9,8 @@ import (
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/pkg/errors"
 	"github.com/ysmood/gson"
+
+	"github.com/totaltube/conversion/helpers"
 )
 
 type ContentTypes []ContentType
@@ -105,6 +107,39 @@ func (s *Size) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// FrameQuality thresholds reject blurry, dark, washed out and uniform frames extracted from videos.
+// All values are in 0..1 range of helpers.ImageScore, zero disables the check.
+// DedupDistance rejects frames and images with dHash within this Hamming distance of an already accepted one.
+// Rejected frames are replaced with frames from nearby timestamps, ReplaceAttempts of them (3 by default),
+// the rest are refilled from other timestamps. Items are scored and scores are returned only when any check is set.
+type FrameQuality struct {
+	MinSharpness    float64 `json:"min_sharpness"`
+	MinBrightness   float64 `json:"min_brightness"`
+	MaxBrightness   float64 `json:"max_brightness"`
+	MinEntropy      float64 `json:"min_entropy"`
+	DedupDistance   int32   `json:"dedup_distance"`
+	ReplaceAttempts int32   `json:"replace_attempts"`
+}
+
+// Enabled tells if frames are filtered by any threshold or deduplicated
+func (q FrameQuality) Enabled() bool {
+	return q.MinSharpness > 0 || q.MinBrightness > 0 || q.MaxBrightness > 0 || q.MinEntropy > 0 || q.DedupDistance > 0
+}
+
+// Accepts checks the score against the thresholds
+func (q FrameQuality) Accepts(score helpers.ImageScore) bool {
+	return score.Sharpness >= q.MinSharpness && score.Brightness >= q.MinBrightness &&
+		(q.MaxBrightness <= 0 || score.Brightness <= q.MaxBrightness) && score.Entropy >= q.MinEntropy
+}
+
+// PreviewRendition is a size of the video preview. Retina adds @2x variant of double size and bitrate
+// when the source is large enough.
+type PreviewRendition struct {
+	Size         Size  `json:"size"`
+	VideoBitrate int64 `json:"video_bitrate"`
+	Retina       bool  `json:"retina"`
+}
+
 type ThumbFormat struct {
 	Name                string        `json:"name"`
 	Sites               []int64       `json:"sites"`
@@ -141,6 +176,35 @@ type ThumbFormatShort struct {
 	SegmentsCount       int64    `json:"segments_count"`
 	SegmentDuration     float64  `json:"segment_duration"`
 	VideoBitrate        int64    `json:"video_bitrate"`
+	// PreviewRenditions encode video-preview-<name>-<W>x<H>.<ext> files of several sizes from the same segments
+	// instead of the single VideoSize/VideoBitrate one
+	PreviewRenditions []PreviewRendition `json:"preview_renditions"`
+	// SegmentSelection is "even" (default) to spread segments over the video or "scored" to pick
+	// the most active and well exposed parts. SkipIntroPercent and SkipOutroPercent exclude
+	// beginning and end of the video from the selection.
+	SegmentSelection string  `json:"segment_selection"`
+	SkipIntroPercent float64 `json:"skip_intro_percent"`
+	SkipOutroPercent float64 `json:"skip_outro_percent"`
+	// TransitionType is ffmpeg xfade transition (fade, dissolve, wipeleft, ...) between preview segments,
+	// empty for hard cuts. PreviewAudio keeps the sound crossfaded between segments and faded in and out.
+	TransitionType     string  `json:"transition_type"`
+	TransitionDuration float64 `json:"transition_duration"`
+	PreviewAudio       bool    `json:"preview_audio"`
+	AudioBitrate       int64   `json:"audio_bitrate"`
+	// Metadata of the video preview, source metadata is stripped by default
+	Metadata OutputMetadata `json:"metadata"`
+	// CreateAnimatedPreview makes animated-preview-<name>.<type> image (webp, gif or apng) from the preview segments.
+	// AnimatedLoop is the amount of loops, zero loops forever. When AnimatedMaxBytes is set the image
+	// is re-encoded with smaller size and frame rate until it fits.
+	CreateAnimatedPreview bool    `json:"create_animated_preview"`
+	AnimatedType          string  `json:"animated_type"`
+	AnimatedSize          Size    `json:"animated_size"`
+	AnimatedFPS           float64 `json:"animated_fps"`
+	AnimatedLoop          int32   `json:"animated_loop"`
+	AnimatedMaxBytes      int64   `json:"animated_max_bytes"`
+	// KeyframesOnly extracts frames from the nearest keyframes, faster but less precise
+	KeyframesOnly bool `json:"keyframes_only"`
+	FrameQuality
 }
 
 func (tf ThumbFormat) CompatMarshalJSON() ([]byte, error) {
@@ -328,6 +392,9 @@ type GalleryFormatShort struct {
 	MaxAmount       int64   `json:"max_amount"`
 	MinAmount       int64   `json:"min_amount"`
 	Type            string  `json:"type"`
+	// KeyframesOnly extracts frames of video sources from the nearest keyframes, faster but less precise
+	KeyframesOnly bool `json:"keyframes_only"`
+	FrameQuality
 }
 
 type VideoFormat struct {
@@ -371,6 +438,71 @@ type VideoFormatShort struct {
 	TimelineMaxAmount   int32      `json:"timeline_max_amount"`
 	TimelineMinInterval float32    `json:"timeline_min_interval"`
 	TimelineType        string     `json:"timeline_type"`
+	// TimelineColumns arranges timeline frames into a grid, zero makes every sheet a single row.
+	// Frames are split into several timeline-<name>.<i>.<type> sheets when a sheet would exceed
+	// TimelineMaxSheetSize pixels in width or height (16383 by default).
+	TimelineColumns      int32 `json:"timeline_columns"`
+	TimelineMaxSheetSize int32 `json:"timeline_max_sheet_size"`
+	// QualityCheck compares output with the source on sampled segments, QualityMetric is vmaf (default), ssim or psnr.
+	// vmaf falls back to ssim when ffmpeg is built without libvmaf, quality_min_ssim is required then if quality_min_vmaf is set.
+	QualityCheck          bool    `json:"quality_check"`
+	QualityMetric         string  `json:"quality_metric"`
+	QualitySamples        int32   `json:"quality_samples"`
+	QualitySampleDuration float64 `json:"quality_sample_duration"`
+	QualityMinVMAF        float64 `json:"quality_min_vmaf"`
+	QualityMinSSIM        float64 `json:"quality_min_ssim"`
+	QualityMinPSNR        float64 `json:"quality_min_psnr"`
+	// ValidateSource checks sources for truncation and decode errors before conversion,
+	// RepairSource tries to fix damaged sources with error-tolerant remux instead of failing
+	ValidateSource bool `json:"validate_source"`
+	RepairSource   bool `json:"repair_source"`
+	// CreateChapters detects scenes in the result video and merges them into chapters-<name>.vtt/json,
+	// chapters-<name>.thumbs.vtt maps the chapters to thumbnails of ChaptersThumbType (jpg, webp or png)
+	CreateChapters         bool    `json:"create_chapters"`
+	ChaptersMinLength      float64 `json:"chapters_min_length"`
+	ChaptersSceneThreshold float64 `json:"chapters_scene_threshold"`
+	ChaptersThumbSize      Size    `json:"chapters_thumb_size"`
+	ChaptersThumbType      string  `json:"chapters_thumb_type"`
+	// KeyframeInterval in seconds forces keyframes at fixed positions, for hls type it should divide HLSSegmentDuration
+	KeyframeInterval   float64 `json:"keyframe_interval"`
+	DisableSceneCut    bool    `json:"disable_scene_cut"`
+	ClosedGOP          bool    `json:"closed_gop"`
+	HLSSegmentDuration float64 `json:"hls_segment_duration"`
+	// HLSEncrypt encrypts hls segments with AES-128, HLSKeyURI is required then. It's the URI players fetch the key from,
+	// with %NAME% placeholder. The key is uploaded to key_destination only. Encrypted video gets no I-frame playlist.
+	HLSEncrypt bool   `json:"hls_encrypt"`
+	HLSKeyURI  string `json:"hls_key_uri"`
+	// PosterCandidates is the amount of frames sampled over PosterTimeRange to choose the best poster from,
+	// zero or one takes a single frame at a random point of the range
+	PosterCandidates int32 `json:"poster_candidates"`
+	// PosterSizes creates additional poster-<name>-<W>x<H>.<type> files, PosterRetina adds @2x variants of them
+	// when the frame is large enough
+	PosterSizes  []Size `json:"poster_sizes"`
+	PosterRetina bool   `json:"poster_retina"`
+	// Metadata of the result video, source metadata is stripped by default. Custom Command gets the options
+	// before the last %RESULT_FILE% unless it places %METADATA_OPTIONS% itself.
+	Metadata OutputMetadata `json:"metadata"`
+}
+
+// RemuxFormatShort describes rewrapping of a video into another container without re-encoding
+type RemuxFormatShort struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	NoAudio       bool   `json:"no_audio"`
+	KeepSubtitles bool   `json:"keep_subtitles"`
+	// Metadata of the result video, source metadata is stripped by default
+	Metadata OutputMetadata `json:"metadata"`
+}
+
+// OutputMetadata controls container and stream metadata of created videos.
+// Source metadata (encoder, device, location, titles) is dropped unless Keep is set,
+// non-empty Title, Comment, Copyright and ContentID are written as tags.
+type OutputMetadata struct {
+	Keep      bool   `json:"keep"`
+	Title     string `json:"title"`
+	Comment   string `json:"comment"`
+	Copyright string `json:"copyright"`
+	ContentID string `json:"content_id"`
 }
 
 func (f VideoFormat) Validate() error {
@@ -408,4 +540,8 @@ type FStream struct {
 	Duration           string `json:"duration"`
 	BitRate            string `json:"bit_rate"`
 	DisplayAspectRatio string `json:"display_aspect_ratio"`
+	RFrameRate         string `json:"r_frame_rate"`
+	SampleRate         string `json:"sample_rate"`
+	Channels           int    `json:"channels"`
+	ChannelLayout      string `json:"channel_layout"`
 }
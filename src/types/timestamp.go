@@ -0,0 +1,85 @@
+package types
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/totaltube/conversion/helpers"
+)
+
+// Timestamp is a moment of the video given as a number of seconds, a percentage of the duration ("25%"),
+// clock time ("01:30", "1:02:03.5") or human duration ("1m30s")
+type Timestamp struct {
+	Seconds   float64
+	Percent   float64
+	IsPercent bool
+}
+
+// At returns the timestamp in seconds for the video of the duration
+func (t Timestamp) At(duration float64) float64 {
+	if t.IsPercent {
+		return duration * t.Percent / 100
+	}
+	return t.Seconds
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsPercent {
+		return json.Marshal(strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%")
+	}
+	return json.Marshal(t.Seconds)
+}
+
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	*t = Timestamp{}
+	if err := json.Unmarshal(b, &t.Seconds); err == nil {
+		if t.Seconds < 0 {
+			return errors.New("negative timestamp")
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("timestamp should be a number or a string")
+	}
+	return t.parse(strings.TrimSpace(s))
+}
+
+func (t *Timestamp) parse(s string) (err error) {
+	switch {
+	case strings.HasSuffix(s, "%"):
+		t.IsPercent = true
+		t.Percent, err = strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil || t.Percent < 0 || t.Percent > 100 {
+			return errors.New("wrong timestamp percentage " + s)
+		}
+	case strings.Contains(s, ":"):
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return errors.New("wrong timestamp " + s)
+		}
+		for _, part := range parts {
+			var v float64
+			if v, err = strconv.ParseFloat(part, 64); err != nil || v < 0 {
+				return errors.New("wrong timestamp " + s)
+			}
+			t.Seconds = t.Seconds*60 + v
+		}
+	default:
+		if t.Seconds, err = strconv.ParseFloat(s, 64); err == nil {
+			if t.Seconds < 0 {
+				return errors.New("negative timestamp " + s)
+			}
+			return nil
+		}
+		err = nil
+		t.Seconds = helpers.ParseHumanDuration(s).Seconds()
+		if t.Seconds == 0 && strings.Trim(s, "0.smhd ") != "" {
+			return errors.New("wrong timestamp " + s)
+		}
+	}
+	return
+}
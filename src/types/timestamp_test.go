@@ -0,0 +1,26 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTimestampUnmarshal(t *testing.T) {
+	var timestamps []Timestamp
+	err := json.Unmarshal([]byte(`[12.5, "25%", "90", "01:30", "1:02:03.5", "1m30s", "0"]`), &timestamps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []float64{12.5, 50, 90, 90, 3723.5, 90, 0}
+	for k, timestamp := range timestamps {
+		if at := timestamp.At(200); at != expected[k] {
+			t.Errorf("timestamp %d: expected %f, got %f", k, expected[k], at)
+		}
+	}
+	for _, wrong := range []string{`"abc"`, `"120%"`, `-5`, `"1:xx"`, `"1:2:3:4"`, `true`} {
+		var timestamp Timestamp
+		if err = json.Unmarshal([]byte(wrong), &timestamp); err == nil {
+			t.Errorf("%s should not parse", wrong)
+		}
+	}
+}